@@ -1,9 +1,15 @@
 package cam
 
+/*
+*	LocalOnly accounts are CouchDB endpoints that only the machine
+*	running the plugin can reach. They are replicated by the plugin
+*	itself instead of through _replicator documents.
+ */
 type CloudantAccount struct {
-	Endpoint string
-	Username string
-	Password string
-	Url      string
-	Cookie   string
+	Endpoint  string
+	Username  string
+	Password  string
+	Url       string
+	Cookie    string
+	LocalOnly bool
 }
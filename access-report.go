@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+*	The roles every principal holds on one database, by the username
+*	of the account the database lives in. Accounts without the
+*	database have no entry.
+ */
+type DatabaseAccess map[string]map[string][]string
+
+/*
+*	Reads the permissions of every database in every region and
+*	prints, for each database, the roles of each principal in each
+*	region. Principals whose roles differ between regions and grants
+*	the plugin made that no replication uses any more are highlighted.
+ */
+func accessReport(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	fmt.Println("\nReading the existing replications\n")
+	docs := getAllReplicationDocuments(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	fmt.Println("\nReading database permissions\n")
+	access, added := getDatabaseAccess(httpClient, cloudantAccounts, flags.Dbs, flags.ReplicatorDb)
+	deleteCookies(httpClient, cloudantAccounts)
+	var dbs []string
+	for db := range access {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	fmt.Println(terminal.ColorizeBold("\nACCESS REPORT", 35))
+	var differing, stale []string
+	for i := 0; i < len(dbs); i++ {
+		d, s := printDatabaseAccess(dbs[i], access[dbs[i]], added[dbs[i]], cloudantAccounts, docs)
+		differing = append(differing, d...)
+		stale = append(stale, s...)
+	}
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\nRead the permissions of " + strconv.Itoa(len(dbs)) + " databases in " + strconv.Itoa(len(cloudantAccounts)) + " regions")
+	if len(differing) > 0 {
+		fmt.Println("\nRoles that differ between regions (" + terminal.ColorizeBold("*", 33) + "):\n")
+		for i := 0; i < len(differing); i++ {
+			fmt.Println(differing[i])
+		}
+	}
+	if len(stale) > 0 {
+		fmt.Println("\nGrants the plugin made that no replication of the database uses any more (" + terminal.ColorizeBold("!", 31) + "):\n")
+		for i := 0; i < len(stale); i++ {
+			fmt.Println(stale[i])
+		}
+	}
+	if len(differing) == 0 && len(stale) == 0 {
+		fmt.Println("\nThe roles are the same in every region and every grant the plugin made is used by a replication")
+	}
+}
+
+/*
+*	Reads the _security document of every database in every account.
+*	With dbs only those databases are read. Databases whose
+*	permissions can't be read are reported and left out. Also returns
+*	the principals the plugin added, by database and account username.
+ */
+func getDatabaseAccess(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, dbs []string, replicatorDb string) (map[string]DatabaseAccess, map[string]map[string][]string) {
+	access := make(map[string]DatabaseAccess)
+	added := make(map[string]map[string][]string)
+	type accessResult struct {
+		Db       string
+		Username string
+		Grantees map[string][]string
+		Added    []string
+	}
+	responses := make(chan bcr_utils.HttpResponse)
+	result_ch := make(chan accessResult)
+	numRequests := 0
+	for i := 0; i < len(cloudantAccounts); i++ {
+		accountDbs := bcr_utils.GetDatabases(httpClient, cloudantAccounts[i])
+		for j := 0; j < len(accountDbs); j++ {
+			db := accountDbs[j]
+			if strings.HasPrefix(db, "_") || db == replicatorDb || (len(dbs) > 0 && !bcr_utils.IsValid(db, dbs)) {
+				continue
+			}
+			numRequests += 1
+			go func(httpClient *http.Client, account cam.CloudantAccount, db string) {
+				sec, r := getSecurity(db, httpClient, account)
+				split_status := strings.Split(r.Status, " ")[0]
+				status, _ := strconv.Atoi(split_status)
+				if status != 200 || r.Err != nil {
+					r.Err = errors.New("Unable to read the permissions of '" + terminal.ColorizeBold(db, 36) + "' in '" +
+						terminal.ColorizeBold(account.Endpoint, 36) + "'")
+					responses <- r
+					result_ch <- accessResult{}
+					return
+				}
+				responses <- r
+				result_ch <- accessResult{Db: db, Username: account.Username, Grantees: getGrantees(sec), Added: getPluginMembers(sec)}
+			}(httpClient, cloudantAccounts[i], db)
+		}
+	}
+	bcr_utils.CheckHttpResponses(responses, numRequests)
+	close(responses)
+	for i := 0; i < numRequests; i++ {
+		result := <-result_ch
+		if result.Db == "" {
+			continue
+		}
+		if access[result.Db] == nil {
+			access[result.Db] = make(DatabaseAccess)
+			added[result.Db] = make(map[string][]string)
+		}
+		access[result.Db][result.Username] = result.Grantees
+		added[result.Db][result.Username] = result.Added
+	}
+	close(result_ch)
+	return access, added
+}
+
+/*
+*	Prints the roles of each principal on db in every region, one
+*	column per region. A region's own account is shown as "owner", a
+*	region without the database as "n/a". Returns a line for every
+*	principal whose roles differ between regions and for every stale
+*	grant: a grant to a region of the app that no replication of db
+*	connects with, or to a principal the plugin added, such as an API
+*	key, that no replication document names any more. Other
+*	principals, e.g. the app's own credentials, are never stale.
+ */
+func printDatabaseAccess(db string, dbAccess DatabaseAccess, added map[string][]string, cloudantAccounts []cam.CloudantAccount, docs []ReplicationDocument) ([]string, []string) {
+	var differing, stale []string
+	var principals []string
+	for _, grantees := range dbAccess {
+		for principal := range grantees {
+			if !bcr_utils.IsValid(principal, principals) {
+				principals = append(principals, principal)
+			}
+		}
+	}
+	sort.Strings(principals)
+	header := []string{"PRINCIPAL"}
+	for i := 0; i < len(cloudantAccounts); i++ {
+		header = append(header, bcr_utils.GetRegion(cloudantAccounts[i].Endpoint))
+	}
+	rows := [][]string{header}
+	colors := [][]terminal.Color{make([]terminal.Color, len(header))}
+	for i := 0; i < len(principals); i++ {
+		name := principals[i]
+		grantee, isAccount := findAccountByUsername(principals[i], cloudantAccounts)
+		if isAccount {
+			name += " (" + bcr_utils.GetRegion(grantee.Endpoint) + ")"
+		}
+		row := []string{name}
+		rowColors := make([]terminal.Color, len(header))
+		var compared []string
+		for j := 0; j < len(cloudantAccounts); j++ {
+			grantees, found := dbAccess[cloudantAccounts[j].Username]
+			roles := grantees[principals[i]]
+			sort.Strings(roles)
+			cell := strings.Join(roles, ",")
+			if cell == "" {
+				cell = "-"
+			}
+			if !found {
+				row = append(row, "n/a")
+				continue
+			}
+			if principals[i] == cloudantAccounts[j].Username {
+				row = append(row, "owner")
+				continue
+			}
+			compared = append(compared, cell)
+			isStale := false
+			if isAccount {
+				isStale = !isReplicatedWith(db, grantee, cloudantAccounts[j], docs) && !isReplicationCredential(db, principals[i], cloudantAccounts[j], docs)
+			} else {
+				isStale = bcr_utils.IsValid(principals[i], added[cloudantAccounts[j].Username]) && !isNamedInReplications(principals[i], docs)
+			}
+			if len(roles) > 0 && isStale {
+				cell += "!"
+				rowColors[j+1] = 31
+				holder := principals[i]
+				if isAccount {
+					holder = grantee.Endpoint
+				}
+				stale = append(stale, terminal.ColorizeBold(db, 36)+": "+holder+" holds "+strings.Join(roles, ", ")+
+					" in "+cloudantAccounts[j].Endpoint)
+			}
+			row = append(row, cell)
+		}
+		for j := 1; j < len(compared); j++ {
+			if compared[j] != compared[0] {
+				row[0] = "* " + row[0]
+				rowColors[0] = 33
+				differing = append(differing, terminal.ColorizeBold(db, 36)+": "+name)
+				break
+			}
+		}
+		if rowColors[0] == 0 {
+			row[0] = "  " + row[0]
+		}
+		rows = append(rows, row)
+		colors = append(colors, rowColors)
+	}
+	rows[0][0] = "  " + rows[0][0]
+	widths := make([]int, len(header))
+	for i := 0; i < len(rows); i++ {
+		for j := 0; j < len(rows[i]); j++ {
+			if len(rows[i][j]) > widths[j] {
+				widths[j] = len(rows[i][j])
+			}
+		}
+	}
+	fmt.Println("\n" + terminal.ColorizeBold(db, 36) + "\n")
+	for i := 0; i < len(rows); i++ {
+		line := ""
+		for j := 0; j < len(rows[i]); j++ {
+			cell := rows[i][j] + strings.Repeat(" ", widths[j]-len(rows[i][j])+2)
+			if colors[i][j] != 0 {
+				cell = terminal.ColorizeBold(rows[i][j], colors[i][j]) + strings.Repeat(" ", widths[j]-len(rows[i][j])+2)
+			}
+			line += cell
+		}
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	return differing, stale
+}
+
+/*
+*	Returns whether a replication document uses principal as the
+*	credentials for db in account
+ */
+func isReplicationCredential(db string, principal string, account cam.CloudantAccount, docs []ReplicationDocument) bool {
+	for i := 0; i < len(docs); i++ {
+		if docs[i].SourceAccount == account.Username && docs[i].SourceDb == db &&
+			getReplicationCredential(docs[i].Doc["source"]) == principal {
+			return true
+		}
+		if docs[i].TargetAccount == account.Username && docs[i].TargetDb == db &&
+			getReplicationCredential(docs[i].Doc["target"]) == principal {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Returns whether any replication document uses principal as the
+*	credentials of its source or target
+ */
+func isNamedInReplications(principal string, docs []ReplicationDocument) bool {
+	for i := 0; i < len(docs); i++ {
+		if getReplicationCredential(docs[i].Doc["source"]) == principal || getReplicationCredential(docs[i].Doc["target"]) == principal {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Returns whether a replication document replicates db between the
+*	two accounts, in either direction
+ */
+func isReplicatedWith(db string, grantee cam.CloudantAccount, account cam.CloudantAccount, docs []ReplicationDocument) bool {
+	for i := 0; i < len(docs); i++ {
+		if docs[i].SourceDb != db && docs[i].TargetDb != db {
+			continue
+		}
+		if (docs[i].SourceAccount == grantee.Username && docs[i].TargetAccount == account.Username) ||
+			(docs[i].SourceAccount == account.Username && docs[i].TargetAccount == grantee.Username) {
+			return true
+		}
+	}
+	return false
+}
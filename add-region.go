@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+*	Adds a region to an existing replication mesh. The databases
+*	replicated between the other regions are created in the new
+*	region, shared with it and linked to it, without touching the
+*	replications that already exist.
+ */
+func addRegion(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if len(flags.Args) != 1 {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the region to add. For help look to '" +
+			terminal.ColorizeBold("cf help cloudant-add-region", 33) + "'"))
+	}
+	region := flags.Args[0]
+	if strings.HasPrefix(region, "https://") && !bcr_utils.IsValid(region, ENDPOINTS) {
+		ENDPOINTS = append(ENDPOINTS, region)
+	}
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	restore := getFinalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	defer restore()
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	template, err := getReplicationTemplate(flags)
+	bcr_utils.CheckErrorFatal(err)
+	rules, err := readRedactionRules(flags.RedactionRules, cloudantAccounts)
+	bcr_utils.CheckErrorFatal(err)
+	policy, err := readPolicy(flags.Policy)
+	bcr_utils.CheckErrorFatal(err)
+	newAccount, found := bcr_utils.FindAccount(region, cloudantAccounts)
+	if !found {
+		bcr_utils.CheckErrorFatal(errors.New("No Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
+			"' in region '" + terminal.ColorizeBold(region, 36) + "'"))
+	}
+	var meshAccounts []cam.CloudantAccount
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if cloudantAccounts[i].Username != newAccount.Username {
+			meshAccounts = append(meshAccounts, cloudantAccounts[i])
+		}
+	}
+	fmt.Println("\nReading the existing replications\n")
+	mesh := getMeshDatabases(getAllReplicationDocuments(httpClient, meshAccounts, flags.ReplicatorDb), meshAccounts)
+	dbs := flags.Dbs
+	if len(dbs) == 0 {
+		for db := range mesh {
+			dbs = append(dbs, db)
+		}
+		sort.Strings(dbs)
+	}
+	if len(dbs) == 0 {
+		bcr_utils.CheckErrorFatal(errors.New("No existing replications were found in '" +
+			terminal.ColorizeBold(flags.ReplicatorDb, 36) + "' of the other regions"))
+	}
+	var violations []string
+	for i := 0; i < len(dbs); i++ {
+		members := getMeshMembers(dbs[i], mesh, meshAccounts)
+		violations = append(violations, getPolicyViolations(policy, dbs[i], []cam.CloudantAccount{newAccount},
+			append(members, newAccount), getRegionReplications(newAccount, members), flags.Placement)...)
+	}
+	enforcePolicy(violations, flags.Policy)
+	createDatabase(flags.ReplicatorDb, httpClient, []cam.CloudantAccount{newAccount})
+	unredacted := deleteUnredactedReplications(httpClient, cloudantAccounts, rules, dbs, flags.ReplicatorDb)
+	var results []ReplicationResult
+	pending := make(map[string][]Replication)
+	redacted := make(map[string][]Replication)
+	numReplications := 0
+	for i := 0; i < len(dbs); i++ {
+		members := getMeshMembers(dbs[i], mesh, meshAccounts)
+		replications := getRegionReplications(newAccount, members)
+		createDatabase(dbs[i], httpClient, []cam.CloudantAccount{newAccount})
+		if r := getRedactedReplications(replications, rules); len(r) > 0 {
+			redacted[dbs[i]] = r
+		}
+		dbResults, _ := linkDatabase(dbs[i], httpClient, append(members, newAccount), replications, flags, template, rules, pending, nil)
+		results = append(results, dbResults...)
+		numReplications += len(replications)
+	}
+	deleteCookies(httpClient, cloudantAccounts)
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\n'" + terminal.ColorizeBold(newAccount.Endpoint, 36) + "' was added to the replication of '" +
+		terminal.ColorizeBold(appname, 36) + "' with " + strconv.Itoa(numReplications) + " new replications for:\n")
+	for i := 0; i < len(dbs); i++ {
+		fmt.Println(terminal.ColorizeBold(dbs[i], 36))
+	}
+	if flags.Once {
+		printReplicationResults(results)
+	} else {
+		printLocalResults(results)
+	}
+	printRedactedReplications(dbs, redacted, rules, unredacted)
+	printSecuritySnapshot()
+	runContinuousLocalReplications(httpClient, pending, flags, template, rules, restore)
+}
+
+/*
+*	Returns the databases that are replicated between accounts,
+*	along with the accounts each one is replicated between
+ */
+func getMeshDatabases(docs []ReplicationDocument, accounts []cam.CloudantAccount) map[string][]cam.CloudantAccount {
+	mesh := make(map[string][]cam.CloudantAccount)
+	for i := 0; i < len(docs); i++ {
+		if docs[i].SourceDb == "" || docs[i].SourceDb != docs[i].TargetDb {
+			continue
+		}
+		source, sourceFound := findAccountByUsername(docs[i].SourceAccount, accounts)
+		target, targetFound := findAccountByUsername(docs[i].TargetAccount, accounts)
+		if !sourceFound || !targetFound {
+			continue
+		}
+		members := mesh[docs[i].SourceDb]
+		if _, found := findAccountByUsername(source.Username, members); !found {
+			members = append(members, source)
+		}
+		if _, found := findAccountByUsername(target.Username, members); !found {
+			members = append(members, target)
+		}
+		mesh[docs[i].SourceDb] = members
+	}
+	return mesh
+}
+
+/*
+*	Returns the accounts db is replicated between. Databases without
+*	existing replications are replicated between all of meshAccounts.
+ */
+func getMeshMembers(db string, mesh map[string][]cam.CloudantAccount, meshAccounts []cam.CloudantAccount) []cam.CloudantAccount {
+	members, found := mesh[db]
+	if !found {
+		return meshAccounts
+	}
+	return members
+}
+
+/*
+*	Returns the replications to and from newAccount and each member
+ */
+func getRegionReplications(newAccount cam.CloudantAccount, members []cam.CloudantAccount) []Replication {
+	var replications []Replication
+	for i := 0; i < len(members); i++ {
+		replications = append(replications, Replication{Source: members[i], Target: newAccount})
+		replications = append(replications, Replication{Source: newAccount, Target: members[i]})
+	}
+	return replications
+}
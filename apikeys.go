@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+*	A Cloudant API key, which can be granted roles on the databases
+*	of any account
+ */
+type ApiKey struct {
+	Key      string `json:"key"`
+	Password string `json:"password"`
+}
+
+/*
+*	Generates a new API key through account
+ */
+func createApiKey(httpClient *http.Client, account cam.CloudantAccount) (ApiKey, error) {
+	var key ApiKey
+	url := "https://" + account.Username + ".cloudant.com/_api/v2/api_keys"
+	headers := map[string]string{"Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "POST", url, "", headers)
+	if err != nil {
+		return key, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	json.Unmarshal(respBody, &key)
+	if status != 201 && status != 200 || key.Key == "" {
+		return key, errors.New("Unable to generate an API key in '" + terminal.ColorizeBold(account.Endpoint, 36) + "'")
+	}
+	return key, nil
+}
+
+/*
+*	Generates a dedicated API key for each replication of db, through
+*	the account its replication document is written to. A replication
+*	whose document already exists keeps the key the document holds, so
+*	that running again doesn't leave unused keys behind. Replications
+*	whose key can't be generated are reported and left out, rather
+*	than falling back to the account credentials.
+ */
+func addApiKeys(httpClient *http.Client, db string, replications []Replication, flags bcr_utils.Flags) []Replication {
+	fmt.Println("\nGenerating API keys\n")
+	var keyed []Replication
+	key_ch := make(chan Replication)
+	for i := 0; i < len(replications); i++ {
+		go func(httpClient *http.Client, replication Replication) {
+			owner := getReplicationOwner(replication, flags.Placement)
+			found := false
+			if !flags.Once {
+				docId := getReplicationDocId(replication, db, flags.Placement)
+				replication.Key, found = getExistingApiKey(httpClient, owner, flags.ReplicatorDb, docId, replication)
+			}
+			if !found {
+				key, err := createApiKey(httpClient, owner)
+				if !bcr_utils.CheckErrorNonFatal(err) {
+					replication.Key = key
+				}
+			}
+			key_ch <- replication
+		}(httpClient, replications[i])
+	}
+	for i := 0; i < len(replications); i++ {
+		replication := <-key_ch
+		if replication.Key.Key != "" {
+			keyed = append(keyed, replication)
+		}
+	}
+	close(key_ch)
+	return keyed
+}
+
+/*
+*	Returns the API key used by the existing replication document
+*	docId, or by its shards, in account's replicator database. Documents
+*	using the account credentials of the replication hold no key.
+ */
+func getExistingApiKey(httpClient *http.Client, account cam.CloudantAccount, replicatorDb string, docId string, replication Replication) (ApiKey, bool) {
+	docs, err := getReplicationDocuments(httpClient, account, replicatorDb)
+	if err != nil {
+		return ApiKey{}, false
+	}
+	for i := 0; i < len(docs); i++ {
+		if docs[i].Id != docId && !strings.HasPrefix(docs[i].Id, docId+"-shard-") {
+			continue
+		}
+		source := getReplicationUserinfo(docs[i].Doc["source"])
+		target := getReplicationUserinfo(docs[i].Doc["target"])
+		if source == nil || target == nil || source.String() != target.String() {
+			continue
+		}
+		password, _ := source.Password()
+		key := ApiKey{Key: source.Username(), Password: password}
+		if key.Key != replication.Source.Username && key.Key != replication.Target.Username && key.Password != "" {
+			return key, true
+		}
+	}
+	return ApiKey{}, false
+}
+
+/*
+*	Returns the credentials in the URL of the source or target of a
+*	replication document, if it holds any
+ */
+func getReplicationUserinfo(endpoint interface{}) *url.Userinfo {
+	raw, ok := endpoint.(string)
+	if obj, isObj := endpoint.(map[string]interface{}); isObj {
+		raw, ok = obj["url"].(string)
+	}
+	if !ok {
+		return nil
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	return parsed.User
+}
+
+/*
+*	Returns the API keys named in the replication documents of db,
+*	i.e. the credentials that aren't one of the accounts
+ */
+func getReplicationKeys(db string, docs []ReplicationDocument, cloudantAccounts []cam.CloudantAccount) []string {
+	var keys []string
+	for i := 0; i < len(docs); i++ {
+		var credentials []string
+		if docs[i].SourceDb == db {
+			credentials = append(credentials, getReplicationCredential(docs[i].Doc["source"]))
+		}
+		if docs[i].TargetDb == db {
+			credentials = append(credentials, getReplicationCredential(docs[i].Doc["target"]))
+		}
+		for j := 0; j < len(credentials); j++ {
+			if _, isAccount := findAccountByUsername(credentials[j], cloudantAccounts); credentials[j] != "" && !isAccount &&
+				!bcr_utils.IsValid(credentials[j], keys) {
+				keys = append(keys, credentials[j])
+			}
+		}
+	}
+	return keys
+}
+
+/*
+*	Returns the URL of db in account that replication uses: with the
+*	replication's API key if it has one, otherwise with the account
+*	credentials
+ */
+func getReplicationUrl(replication Replication, account cam.CloudantAccount, db string) string {
+	if replication.Key.Key == "" {
+		return account.Url + "/" + db
+	}
+	return "https://" + replication.Key.Key + ":" + replication.Key.Password + "@" + account.Username + ".cloudant.com/" + db
+}
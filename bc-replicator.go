@@ -12,8 +12,11 @@ import (
 	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var ENDPOINTS = []string{"https://api.ng.bluemix.net",
@@ -42,63 +45,182 @@ type BCReplicatorPlugin struct{}
 *	1 should the plugin exits nonzero.
  */
 func (c *BCReplicatorPlugin) Run(cliConnection plugin.CliConnection, args []string) {
-	if args[0] == "cloudant-replicate" {
-		terminal.InitColorSupport()
-		var err error
-		loggedIn, _ := cliConnection.IsLoggedIn()
-		if !loggedIn || err != nil {
-			fmt.Println("Please log in first\n")
-			cliConnection.CliCommand("login")
+	terminal.InitColorSupport()
+	switch args[0] {
+	case "cloudant-replicate":
+		replicate(cliConnection, args)
+	case "cloudant-add-region":
+		addRegion(cliConnection, args)
+	case "cloudant-remove-region":
+		removeRegion(cliConnection, args)
+	case "cloudant-failover":
+		failover(cliConnection, args)
+	case "cloudant-graph":
+		graph(cliConnection, args)
+	case "cloudant-sample":
+		sample(cliConnection, args)
+	case "cloudant-restore-security":
+		restoreSecurity(cliConnection, args)
+	case "cloudant-fence":
+		fence(cliConnection, args)
+	case "cloudant-unfence":
+		unfence(cliConnection, args)
+	case "cloudant-access-report":
+		accessReport(cliConnection, args)
+	}
+}
+
+/*
+*	Sets up replication of the selected databases between all regions
+ */
+func replicate(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	appname, password := getAppAndPassword(cliConnection, flags)
+	dbs := flags.Dbs
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	restore := getFinalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	defer restore()
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	localAccounts, err := getLocalAccounts(flags)
+	bcr_utils.CheckErrorFatal(err)
+	allAccounts := append(append([]cam.CloudantAccount{}, cloudantAccounts...), localAccounts...)
+	replications, err := getReplications(flags, allAccounts)
+	bcr_utils.CheckErrorFatal(err)
+	template, err := getReplicationTemplate(flags)
+	bcr_utils.CheckErrorFatal(err)
+	rules, err := readRedactionRules(flags.RedactionRules, allAccounts)
+	bcr_utils.CheckErrorFatal(err)
+	policy, err := readPolicy(flags.Policy)
+	bcr_utils.CheckErrorFatal(err)
+	if flags.PolicyCheck {
+		numViolations := checkLivePolicy(httpClient, cloudantAccounts, policy, flags.ReplicatorDb)
+		deleteCookies(httpClient, cloudantAccounts)
+		if numViolations > 0 {
+			bcr_utils.CheckErrorFatal(errors.New(strconv.Itoa(numViolations) + " live replications break the policy in '" +
+				terminal.ColorizeBold(flags.Policy, 36) + "'"))
 		}
-		appname, dbs, password, all_dbs, create_dbs := bcr_utils.HandleFlags(args)
-		if appname == "" {
-			appname, err = bcr_prompts.GetAppName(cliConnection)
-			bcr_utils.CheckErrorNonFatal(err)
-			if err != nil {
-				cliConnection.CliCommand("login")
-				appname, err = bcr_prompts.GetAppName(cliConnection)
-				bcr_utils.CheckErrorFatal(err)
-			}
-		} else {
-			apps, _ := bcr_utils.GetAllApps(cliConnection)
-			if !bcr_utils.IsValid(appname, apps) {
-				bcr_utils.CheckErrorFatal(errors.New(appname + " is not a valid app at at your current target.\n"))
-			}
+		return
+	}
+	if flags.DbRegionFile != "" {
+		bcr_utils.CheckErrorFatal(readDatabaseRegions(flags.DbRegionFile, flags.DbRegions))
+	}
+	if flags.AllDbs {
+		dbs = bcr_utils.GetAllDatabases(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	} else if len(dbs) == 0 {
+		dbs, err = bcr_prompts.GetDatabases(httpClient, cloudantAccounts, flags.ReplicatorDb)
+		bcr_utils.CheckErrorFatal(err)
+	}
+	var violations []string
+	for i := 0; i < len(dbs); i++ {
+		dbAccounts := accountsForDatabase(dbs[i], flags.DbRegions, allAccounts)
+		var created []cam.CloudantAccount
+		if flags.Create {
+			created = dbAccounts
 		}
-		if password == "" {
-			password = bcr_prompts.GetPassword()
+		violations = append(violations, getPolicyViolations(policy, dbs[i], created, dbAccounts,
+			replicationsForDatabase(dbs[i], replications, dbAccounts), flags.Placement)...)
+	}
+	enforcePolicy(violations, flags.Policy)
+	createDatabase(flags.ReplicatorDb, httpClient, cloudantAccounts)
+	unredacted := deleteUnredactedReplications(httpClient, cloudantAccounts, rules, dbs, flags.ReplicatorDb)
+	var results []ReplicationResult
+	localReplications := make(map[string][]Replication)
+	redacted := make(map[string][]Replication)
+	var removed []string
+	for i := 0; i < len(dbs); i++ {
+		dbAccounts := accountsForDatabase(dbs[i], flags.DbRegions, allAccounts)
+		if flags.Create {
+			createDatabase(dbs[i], httpClient, getCloudAccounts(dbAccounts))
 		}
-		startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
-		defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
-		var httpClient = &http.Client{}
-		cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
-		bcr_utils.CheckErrorFatal(err)
-		if all_dbs {
-			dbs = bcr_utils.GetAllDatabases(httpClient, cloudantAccounts)
-		} else if len(dbs) == 0 {
-			dbs, err = bcr_prompts.GetDatabases(httpClient, cloudantAccounts)
+		dbReplications := replicationsForDatabase(dbs[i], replications, dbAccounts)
+		if r := getRedactedReplications(dbReplications, rules); len(r) > 0 {
+			redacted[dbs[i]] = r
+		}
+		dbResults, dbRemoved := linkDatabase(dbs[i], httpClient, dbAccounts, dbReplications, flags, template, rules, localReplications, cloudantAccounts)
+		results = append(results, dbResults...)
+		removed = append(removed, dbRemoved...)
+	}
+	deleteCookies(httpClient, cloudantAccounts)
+	finalSummary(appname, cloudantAccounts, flags, results)
+	if len(localAccounts) > 0 {
+		fmt.Println("\nThe following local-only endpoints are replicated by the plugin itself:\n")
+		for i := 0; i < len(localAccounts); i++ {
+			fmt.Println(terminal.ColorizeBold(localAccounts[i].Endpoint, 36))
+		}
+	}
+	printRedactedReplications(dbs, redacted, rules, unredacted)
+	if len(removed) > 0 {
+		fmt.Println("\nRemoved permissions that are no longer needed:\n")
+		for i := 0; i < len(removed); i++ {
+			fmt.Println(removed[i])
+		}
+	}
+	printSecuritySnapshot()
+	runContinuousLocalReplications(httpClient, localReplications, flags, template, rules, restore)
+}
+
+/*
+*	Makes sure the user is logged in and returns the app name and
+*	password, prompting for whichever wasn't passed as a flag
+ */
+func getAppAndPassword(cliConnection plugin.CliConnection, flags bcr_utils.Flags) (string, string) {
+	var err error
+	loggedIn, _ := cliConnection.IsLoggedIn()
+	if !loggedIn || err != nil {
+		fmt.Println("Please log in first\n")
+		cliConnection.CliCommand("login")
+	}
+	appname, password := flags.AppName, flags.Password
+	if appname == "" {
+		appname, err = bcr_prompts.GetAppName(cliConnection)
+		bcr_utils.CheckErrorNonFatal(err)
+		if err != nil {
+			cliConnection.CliCommand("login")
+			appname, err = bcr_prompts.GetAppName(cliConnection)
 			bcr_utils.CheckErrorFatal(err)
 		}
-		createDatabase("_replicator", httpClient, cloudantAccounts)
-		for i := 0; i < len(dbs); i++ {
-			if create_dbs {
-				createDatabase(dbs[i], httpClient, cloudantAccounts)
-			}
-			shareDatabases(dbs[i], httpClient, cloudantAccounts)
-			createReplicationDocuments(dbs[i], httpClient, cloudantAccounts)
+	} else {
+		apps, _ := bcr_utils.GetAllApps(cliConnection)
+		if !bcr_utils.IsValid(appname, apps) {
+			bcr_utils.CheckErrorFatal(errors.New(appname + " is not a valid app at at your current target.\n"))
 		}
-		deleteCookies(httpClient, cloudantAccounts)
-		finalSummary(appname, cloudantAccounts)
 	}
+	if password == "" {
+		password = bcr_prompts.GetPassword()
+	}
+	return appname, password
 }
 
-func finalSummary(appname string, cloudantAccounts []cam.CloudantAccount) {
+func finalSummary(appname string, cloudantAccounts []cam.CloudantAccount, flags bcr_utils.Flags, results []ReplicationResult) {
 	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
 	fmt.Println("\nA Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
 		"' and replication was attempted in the following regions:\n")
 	for i := 0; i < len(cloudantAccounts); i++ {
 		fmt.Println(terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36))
 	}
+	if flags.Topology == "hub" {
+		hub, _ := bcr_utils.FindAccount(flags.Hub, cloudantAccounts)
+		fmt.Println("\nReplications were created in a hub-and-spoke topology with hub '" +
+			terminal.ColorizeBold(hub.Endpoint, 36) + "'")
+	} else if flags.Topology == "primary" {
+		primary, _ := bcr_utils.FindAccount(flags.Primary, cloudantAccounts)
+		fmt.Println("\nReplications were created one-way from primary '" +
+			terminal.ColorizeBold(primary.Endpoint, 36) + "' to all other regions")
+	} else if flags.Topology == "edges" {
+		fmt.Println("\nReplications were created along the edges listed in '" + terminal.ColorizeBold(flags.Edges, 36) + "'")
+	}
+	if flags.Placement == "push" {
+		fmt.Println("\nReplication documents were written to the source region of each replication")
+	}
+	if flags.Once {
+		printReplicationResults(results)
+	} else {
+		printShardedReplications(results)
+		printDocumentOutcomes(results)
+		printLocalResults(results)
+	}
 	if len(cloudantAccounts) != len(ENDPOINTS) {
 		fmt.Println("\nFailed regions:\n")
 		for i := 0; i < len(ENDPOINTS); i++ {
@@ -121,52 +243,159 @@ func finalLogin(cliConnection plugin.CliConnection, endpoint string, username st
 }
 
 /*
-*	Sends all necessary requests to link all databases. These
-*	requests should generate documents in the target's
-*	_replicator database.
+*	Returns a finalLogin that only logs in the first time it is
+*	called, for commands that restore the starting target before the
+*	end, e.g. before running replications in the foreground
+ */
+func getFinalLogin(cliConnection plugin.CliConnection, endpoint string, username string, password string, org string, space string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			finalLogin(cliConnection, endpoint, username, password, org, space)
+		})
+	}
+}
+
+/*
+*	Sends all necessary requests to link the databases along each
+*	replication. These requests should generate documents in the
+*	target's replicator database, or in the source's when "push"
+*	placement is used.
+*
+*	With --once the replications are not continuous. Each one is
+*	followed until it completes and its result is returned.
+*
+*	The fields of template are added to every document. With --shards
+*	the replication of a database that is large enough is split into
+*	several documents that each cover a slice of the document IDs.
  */
-func createReplicationDocuments(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
+func createReplicationDocuments(db string, httpClient *http.Client, replications []Replication, flags bcr_utils.Flags, template ReplicationTemplate) []ReplicationResult {
 	fmt.Println("\nCreating replication documents for '" + terminal.ColorizeBold(db, 36) + "'\n")
 	responses := make(chan bcr_utils.HttpResponse)
-	for i := 0; i < len(cloudantAccounts); i++ {
-		account := cloudantAccounts[i]
-		url := "https://" + account.Username + ".cloudant.com/_replicator"
-		for j := 0; j < len(cloudantAccounts); j++ {
-			if i != j {
-				go func(httpClient *http.Client, target cam.CloudantAccount, source cam.CloudantAccount, db string) {
-					source_dbs := bcr_utils.GetDatabases(httpClient, source)
-					target_dbs := bcr_utils.GetDatabases(httpClient, target)
-					if bcr_utils.IsValid(db, source_dbs) && bcr_utils.IsValid(db, target_dbs) {
-						rep := make(map[string]interface{})
-						rep["_id"] = source.Username + "-" + db
-						rep["source"] = source.Url + "/" + db
-						rep["target"] = target.Url + "/" + db
-						rep["create_target"] = false
-						rep["continuous"] = true
-						bd, _ := json.MarshalIndent(rep, " ", "  ")
-						body := string(bd)
-						headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
-						resp, err := bcr_utils.MakeRequest(httpClient, "POST", url, body, headers)
-						defer resp.Body.Close()
-						respBody, _ := ioutil.ReadAll(resp.Body)
-						split_status := strings.Split(resp.Status, " ")[0]
-						status, err := strconv.Atoi(split_status)
-						bcr_utils.CheckErrorFatal(err)
-						if status != 409 && status != 201 && status != 202 {
-							responses <- bcr_utils.HttpResponse{RequestType: "POST", Status: resp.Status, Body: string(respBody),
-								Err: errors.New("Trouble creating " + rep["_id"].(string) + " for '" + account.Endpoint + "'")}
-						} else {
-							responses <- bcr_utils.HttpResponse{RequestType: "POST", Status: resp.Status, Body: string(respBody), Err: err}
-						}
-					} else {
-						responses <- bcr_utils.HttpResponse{}
+	result_ch := make(chan ReplicationResult)
+	runId := strconv.FormatInt(time.Now().Unix(), 10)
+	for i := 0; i < len(replications); i++ {
+		account := getReplicationOwner(replications[i], flags.Placement)
+		url := "https://" + account.Username + ".cloudant.com/" + flags.ReplicatorDb
+		docId := getReplicationDocId(replications[i], db, flags.Placement)
+		if flags.Once {
+			docId += "-once-" + runId
+		}
+		replication := replications[i]
+		go func(httpClient *http.Client, target cam.CloudantAccount, source cam.CloudantAccount, db string) {
+			source_dbs := bcr_utils.GetDatabases(httpClient, source)
+			target_dbs := bcr_utils.GetDatabases(httpClient, target)
+			if bcr_utils.IsValid(db, source_dbs) && bcr_utils.IsValid(db, target_dbs) {
+				rep := make(map[string]interface{})
+				rep["_id"] = docId
+				rep["source"] = getReplicationUrl(replication, source, db)
+				rep["target"] = getReplicationUrl(replication, target, db)
+				rep["create_target"] = false
+				rep["continuous"] = !flags.Once
+				applyReplicationTemplate(rep, template, db, replication)
+				err := validateReplicationFilters(rep)
+				if filter, ok := rep["filter"].(string); ok && err == nil && !strings.HasPrefix(filter, "_") {
+					err = checkFilterExists(httpClient, source, db, filter)
+				}
+				if err == nil {
+					err = applyDesignDocOption(rep, flags.DesignDocs)
+				}
+				if err != nil {
+					responses <- bcr_utils.HttpResponse{RequestType: "POST", Err: err}
+					result_ch <- ReplicationResult{Source: source.Endpoint, Target: target.Endpoint, Db: db,
+						State: "error", Reason: "replication document could not be created"}
+					return
+				}
+				reps := []map[string]interface{}{rep}
+				if flags.Shards > 1 && rep["filter"] == nil && rep["doc_ids"] == nil &&
+					getDatabaseSize(httpClient, source, db) >= int64(flags.ShardMinSize)*1024*1024 {
+					reps = shardReplicationDocument(rep, flags.Shards)
+				}
+				var r bcr_utils.HttpResponse
+				var docIds []string
+				document := ""
+				for k := 0; k < len(reps); k++ {
+					var outcome string
+					r, outcome = postReplicationDocument(httpClient, account, url, reps[k])
+					if r.Err != nil {
+						break
+					}
+					if outcome == "updated" || (outcome == "unchanged" && document == "") {
+						document = outcome
 					}
-				}(httpClient, account, cloudantAccounts[j], db)
+					docIds = append(docIds, reps[k]["_id"].(string))
+				}
+				if r.Err == nil && !flags.Once {
+					deleted, err := deleteStaleShards(httpClient, account, flags.ReplicatorDb, docId, docIds)
+					if err != nil {
+						r.Err = err
+					} else if deleted {
+						document = "updated"
+					}
+				}
+				responses <- r
+				if r.Err != nil {
+					result_ch <- ReplicationResult{Source: source.Endpoint, Target: target.Endpoint, Db: db, Shards: len(reps),
+						State: "error", Reason: "replication document could not be created"}
+				} else if flags.Once {
+					result := waitForReplication(httpClient, account, flags.ReplicatorDb, docIds, replication, db)
+					if result.State == "completed" {
+						bcr_utils.CheckErrorNonFatal(deleteReplicationDocumentsById(httpClient, account, flags.ReplicatorDb, docIds))
+					}
+					result_ch <- result
+				} else {
+					result_ch <- ReplicationResult{Source: source.Endpoint, Target: target.Endpoint, Db: db, Shards: len(reps),
+						Document: document}
+				}
+			} else {
+				responses <- bcr_utils.HttpResponse{}
+				result_ch <- ReplicationResult{}
 			}
-		}
+		}(httpClient, replications[i].Target, replications[i].Source, db)
 	}
-	bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*(len(cloudantAccounts)-1))
+	bcr_utils.CheckHttpResponses(responses, len(replications))
 	close(responses)
+	if flags.Once && len(replications) > 0 {
+		fmt.Println("\nWaiting for one-shot replications of '" + terminal.ColorizeBold(db, 36) + "' to finish\n")
+	}
+	var results []ReplicationResult
+	for i := 0; i < len(replications); i++ {
+		r := <-result_ch
+		if r.State != "" || r.Shards > 1 || r.Document != "" {
+			results = append(results, r)
+		}
+	}
+	close(result_ch)
+	return results
+}
+
+/*
+*	Writes a replication document to the replicator database at url.
+*	A document that already exists is replaced if its fields differ.
+*	Also returns whether the document was "created", "updated" or left
+*	"unchanged".
+ */
+func postReplicationDocument(httpClient *http.Client, account cam.CloudantAccount, url string, rep map[string]interface{}) (bcr_utils.HttpResponse, string) {
+	bd, _ := json.MarshalIndent(rep, " ", "  ")
+	body := string(bd)
+	headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "POST", url, body, headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "POST", Err: err}, ""
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, err := strconv.Atoi(split_status)
+	bcr_utils.CheckErrorFatal(err)
+	if status == 409 {
+		return updateReplicationDocument(httpClient, account, url, rep)
+	}
+	if status != 201 && status != 202 {
+		return bcr_utils.HttpResponse{RequestType: "POST", Status: resp.Status, Body: string(respBody),
+			Err: errors.New("Trouble creating " + rep["_id"].(string) + " for '" + account.Endpoint + "'")}, ""
+	}
+	return bcr_utils.HttpResponse{RequestType: "POST", Status: resp.Status, Body: string(respBody), Err: err}, "created"
 }
 
 func createDatabase(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
@@ -202,81 +431,158 @@ func getPermissions(db string, httpClient *http.Client, account cam.CloudantAcco
 	url := "https://" + account.Username + ".cloudant.com/_api/v2/db/" + db + "/_security"
 	headers := map[string]string{"Cookie": account.Cookie}
 	resp, err := bcr_utils.MakeRequest(httpClient, "GET", url, "", headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Err: err}
+	}
 	defer resp.Body.Close()
 	respBody, _ := ioutil.ReadAll(resp.Body)
 	return bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody), Err: err}
 }
 
-func modifyPermissions(perms string, db string, httpClient *http.Client, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount) bcr_utils.HttpResponse {
-	var parsed map[string]interface{}
-	json.Unmarshal([]byte(perms), &parsed)
-	for i := 0; i < len(cloudantAccounts); i++ {
-		if account.Username != cloudantAccounts[i].Username {
-			temp_parsed := make(map[string]interface{})
-			if parsed["cloudant"] != nil {
-				temp_parsed = parsed["cloudant"].(map[string]interface{})
-			}
-			if temp_parsed[cloudantAccounts[i].Username] == nil {
-				temp_parsed[cloudantAccounts[i].Username] = []string{"_reader", "_replicator"}
-			} else {
-				currPerms := temp_parsed[cloudantAccounts[i].Username].([]interface{})
-				addRead := true
-				addRep := true
-				for j := 0; j < len(currPerms); j++ {
-					if currPerms[j].(string) == "_reader" {
-						addRead = false
-					}
-					if currPerms[j].(string) == "_replicator" {
-						addRep = false
-					}
-				}
-				if addRead {
-					currPerms = append(currPerms, "_reader")
-				}
-				if addRep {
-					currPerms = append(currPerms, "_replicator")
-				}
-				temp_parsed[cloudantAccounts[i].Username] = currPerms
-			}
-			parsed["cloudant"] = map[string]interface{}(temp_parsed)
+/*
+*	Adds the roles in grants to the permissions of db. The plugin's
+*	roles held by the usernames in prune that grants no longer contain
+*	are removed, and returned keyed by username. Nothing is written
+*	when nothing changes.
+ */
+func modifyPermissions(sec Security, db string, httpClient *http.Client, account cam.CloudantAccount, grants map[string][]string, prune []string) (bcr_utils.HttpResponse, map[string][]string) {
+	if sec.Model == "couchdb" && isPublicDatabase(sec) && len(grants) > 0 {
+		fmt.Println(terminal.ColorizeBold("WARNING", 33) + ": '" + terminal.ColorizeBold(db, 36) + "' in '" +
+			terminal.ColorizeBold(account.Endpoint, 36) + "' has no members, so anyone can access it. No member was added, " +
+			"as that would lock out everyone else. Add the members the database needs by hand to make it private.")
+	}
+	changed, removed := applyGrants(sec, account.Username, grants, prune)
+	if !changed {
+		return bcr_utils.HttpResponse{}, removed
+	}
+	r := putSecurity(sec, db, httpClient, account)
+	if r.Err != nil {
+		return r, map[string][]string{}
+	}
+	return r, removed
+}
+
+/*
+*	Changes sec in place for modifyPermissions. The owner of the
+*	database is never granted or pruned. Returns whether sec changed
+*	and the pruned roles, keyed by username.
+ */
+func applyGrants(sec Security, owner string, grants map[string][]string, prune []string) (bool, map[string][]string) {
+	removed := make(map[string][]string)
+	changed := false
+	for username, roles := range grants {
+		if owner != username && addGrants(sec, username, roles) {
+			changed = true
 		}
 	}
-	url := "https://" + account.Username + ".cloudant.com/_api/v2/db/" + db + "/_security"
-	bd, _ := json.MarshalIndent(parsed, " ", "  ")
-	body := string(bd)
-	headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
-	resp, err := bcr_utils.MakeRequest(httpClient, "PUT", url, body, headers)
-	defer resp.Body.Close()
-	respBody, _ := ioutil.ReadAll(resp.Body)
-	return bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
+	for i := 0; i < len(prune); i++ {
+		if prune[i] == owner {
+			continue
+		}
+		if roles := removeGrants(sec, prune[i], grants[prune[i]]); len(roles) > 0 {
+			removed[prune[i]] = roles
+			changed = true
+		}
+	}
+	return changed, removed
+}
+
+/*
+*	Removes the roles the plugin grants that usernames hold in the
+*	permissions of db. Roles granted by hand, such as _admin, are
+*	kept. Returns the roles that were removed, keyed by username.
+*	Nothing is written when none of usernames holds any.
+ */
+func revokePermissions(sec Security, db string, httpClient *http.Client, account cam.CloudantAccount, usernames []string) (bcr_utils.HttpResponse, map[string][]string) {
+	removed := make(map[string][]string)
+	for i := 0; i < len(usernames); i++ {
+		if roles := removeGrants(sec, usernames[i], nil); len(roles) > 0 {
+			removed[usernames[i]] = roles
+		}
+	}
+	if len(removed) == 0 {
+		return bcr_utils.HttpResponse{}, removed
+	}
+	r := putSecurity(sec, db, httpClient, account)
+	if r.Err != nil {
+		return r, map[string][]string{}
+	}
+	return r, removed
 }
 
 /*
 *	Retrieves the current permissions for each database that is to be
-*	replicated and modifies those permissions to allow read and replicate
-*	permissions for every other database
+*	replicated and modifies those permissions to allow read
+*	permissions for every account replicating from it, or write
+*	permissions for every account replicating into it when "push"
+*	placement is used.
+*
+*	The roles the plugin grants that the accounts in known, or the API
+*	keys named in the replication documents of db, hold without needing
+*	them for replications are removed. Returns a line describing every
+*	removed grant. Pass no known accounts when replications are only
+*	some of the replications of db.
  */
-func shareDatabases(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) {
+func shareDatabases(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, replications []Replication, flags bcr_utils.Flags, known []cam.CloudantAccount) []string {
 	fmt.Println("\nModifying database permissions for '" + terminal.ColorizeBold(db, 36) + "'\n")
+	var removed []string
+	var prune []string
+	for i := 0; i < len(known); i++ {
+		prune = append(prune, known[i].Username)
+	}
+	if len(known) > 0 {
+		docs := getAllReplicationDocuments(httpClient, cloudantAccounts, flags.ReplicatorDb)
+		prune = append(prune, getReplicationKeys(db, docs, known)...)
+	}
 	responses := make(chan bcr_utils.HttpResponse)
+	removed_ch := make(chan []string)
 	for i := 0; i < len(cloudantAccounts); i++ {
-		go func(db string, httpClient *http.Client, account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount) {
-			r := getPermissions(db, httpClient, account)
+		go func(db string, httpClient *http.Client, account cam.CloudantAccount, grants map[string][]string) {
+			var lines []string
+			if len(grants) == 0 && len(prune) == 0 {
+				responses <- bcr_utils.HttpResponse{}
+				responses <- bcr_utils.HttpResponse{}
+				removed_ch <- lines
+				return
+			}
+			sec, r := getSecurity(db, httpClient, account)
 			split_status := strings.Split(r.Status, " ")[0]
 			status, _ := strconv.Atoi(split_status)
 			if status <= 200 && r.Err == nil {
 				responses <- r
-				responses <- modifyPermissions(r.Body, db, httpClient, account, cloudantAccounts)
+				resp, removedRoles := modifyPermissions(sec, db, httpClient, account, grants, prune)
+				if resp.Err == nil {
+					for username, roles := range removedRoles {
+						grantee, isAccount := findAccountByUsername(username, known)
+						name := grantee.Endpoint
+						if !isAccount {
+							name = "API key " + username
+						}
+						lines = append(lines, terminal.ColorizeBold(name, 36)+" ("+strings.Join(roles, ", ")+") from '"+
+							terminal.ColorizeBold(db, 36)+"' in "+account.Endpoint)
+					}
+				}
+				responses <- resp
+			} else if len(grants) == 0 {
+				responses <- bcr_utils.HttpResponse{}
+				responses <- bcr_utils.HttpResponse{}
 			} else {
 				r.Err = errors.New("Permissions GET request failed for '" + terminal.ColorizeBold(account.Endpoint, 36) +
 					"'\nUse the '" + terminal.ColorizeBold("--create", 33) + "' argument to create non-existing databases")
 				responses <- r
 				responses <- bcr_utils.HttpResponse{}
 			}
-		}(db, httpClient, cloudantAccounts[i], cloudantAccounts)
+			removed_ch <- lines
+		}(db, httpClient, cloudantAccounts[i], getGrants(cloudantAccounts[i], replications, flags.Placement))
 	}
 	bcr_utils.CheckHttpResponses(responses, len(cloudantAccounts)*2)
 	close(responses)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		removed = append(removed, <-removed_ch...)
+	}
+	close(removed_ch)
+	sort.Strings(removed)
+	return removed
 }
 
 /*
@@ -350,13 +656,168 @@ func (c *BCReplicatorPlugin) GetMetadata() plugin.PluginMetadata {
 				// UsageDetails is optional
 				// It is used to show help of usage of each command
 				UsageDetails: plugin.Usage{
-					Usage: "cf cloudant-replicate [-a APP] [-d DATABASE] [-p PASSWORD] [--all-dbs] [--create]\n",
+					Usage: "cf cloudant-replicate [-a APP] [-d DATABASE] [-p PASSWORD] [--all-dbs] [--create] [--topology mesh|hub|primary|edges] [--hub REGION] [--primary REGION] [--edges FILE] [--placement push|pull] [--once] [--db-regions DATABASE=REGIONS] [--db-regions-file FILE] [--replicator-db NAME] [--rep-options OPTIONS] [--rep-template FILE] [--shards N] [--shard-min-size MB] [--filter DDOC/NAME] [--query-params PARAMS] [--selector JSON] [--doc-ids IDS] [--skip-design-docs] [--only-design-docs] [--local-only NAME=URL] [--redaction-rules FILE] [--foreground] [--policy FILE] [--policy-check] [--api-keys]\n",
+					Options: map[string]string{
+						"a":                 "App name",
+						"d":                 "Database names to replicate (comma-separated)",
+						"-all-dbs":          "Select all databases",
+						"-create":           "Create non-existing databases",
+						"p":                 "Password",
+						"-topology":         "Replication topology: 'mesh' (default), 'hub', 'primary' or 'edges'",
+						"-primary":          "Region (e.g. ng) that is replicated one-way to all other regions",
+						"-edges":            "Edge-list file with one 'SOURCE -> TARGET [DATABASES]' replication per line",
+						"-placement":        "Write replication documents to the target's (pull, default) or the source's (push) _replicator",
+						"-once":             "Replicate once instead of continuously and wait for every replication to finish",
+						"-db-regions":       "Regions a database lives in, e.g. sessions=ng,eu-gb (may be repeated)",
+						"-db-regions-file":  "File with one 'DATABASE = REGION,REGION' line per database",
+						"-replicator-db":    "Database replication documents are written to (default: _replicator)",
+						"-rep-options":      "Replication options as KEY=VALUE or DATABASE:KEY=VALUE (comma-separated), e.g. worker_processes=4",
+						"-rep-template":     "JSON file with extra fields added to every replication document",
+						"-shards":           "Split each replication into N (2-16) parallel replications over slices of the document IDs",
+						"-shard-min-size":   "Only split databases of at least this many MB (default: 0)",
+						"-filter":           "Filter function (DESIGN_DOC/FILTER) in the source database that documents must pass",
+						"-query-params":     "Query parameters passed to the filter function as KEY=VALUE (comma-separated)",
+						"-selector":         "Mango selector (JSON) that documents must match",
+						"-doc-ids":          "Only replicate these document IDs (comma-separated)",
+						"-skip-design-docs": "Do not replicate design documents",
+						"-only-design-docs": "Only replicate design documents",
+						"-local-only":       "CouchDB endpoint (NAME=URL) that Cloudant can't reach, replicated by the plugin itself",
+						"-redaction-rules":  "JSON file with the fields to drop from documents replicated into each restricted region",
+						"-foreground":       "Keep running the continuous replications the plugin runs itself (local-only and redacted) until Ctrl-C",
+						"-policy":           "File listing the regions each database may exist in or be replicated into",
+						"-policy-check":     "Only report the existing replications that break the policy",
+						"-api-keys":         "Use a new API key for each replication instead of the account credentials",
+						"-hub":              "Region (e.g. eu-gb) that all other regions replicate through with '--topology hub'"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-add-region",
+				HelpText: "adds a region to the existing replication mesh of an app's Cloudant databases",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-add-region REGION [-a APP] [-d DATABASE] [-p PASSWORD] [--placement push|pull] [--once] [--replicator-db NAME] [--rep-options OPTIONS] [--rep-template FILE] [--redaction-rules FILE] [--foreground] [--policy FILE] [--api-keys]\n",
+					Options: map[string]string{
+						"a":                "App name",
+						"d":                "Database names to add to the new region (comma-separated, default: all replicated databases)",
+						"p":                "Password",
+						"-placement":       "Write replication documents to the target's (pull, default) or the source's (push) _replicator",
+						"-once":            "Replicate once instead of continuously and wait for every replication to finish",
+						"-replicator-db":   "Database replication documents are written to (default: _replicator)",
+						"-rep-options":     "Replication options as KEY=VALUE or DATABASE:KEY=VALUE (comma-separated)",
+						"-rep-template":    "JSON file with extra fields added to every replication document",
+						"-redaction-rules": "JSON file with the fields to drop from documents replicated into each restricted region",
+						"-foreground":      "Keep running the continuous replications the plugin runs itself (local-only and redacted) until Ctrl-C",
+						"-policy":          "File listing the regions each database may exist in or be replicated into",
+						"-api-keys":        "Use a new API key for each replication instead of the account credentials"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-remove-region",
+				HelpText: "removes a region from the replication mesh of an app's Cloudant databases",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-remove-region REGION [-a APP] [-p PASSWORD] [--replicator-db NAME]\n",
+					Options: map[string]string{
+						"a":              "App name",
+						"p":              "Password",
+						"-replicator-db": "Database replication documents are read from (default: _replicator)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-failover",
+				HelpText: "promotes a replica region to be the primary that replicates to all other regions",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-failover --to REGION [--from REGION] [-a APP] [-d DATABASE] [-p PASSWORD] [--placement push|pull] [--replicator-db NAME] [--rep-options OPTIONS] [--rep-template FILE] [--redaction-rules FILE] [--foreground] [--policy FILE] [--api-keys]\n",
+					Options: map[string]string{
+						"-to":              "Region to promote to primary",
+						"-from":            "Current primary region (default: the region replicating into the new primary)",
+						"a":                "App name",
+						"d":                "Database names to fail over (comma-separated, default: all replicated databases)",
+						"p":                "Password",
+						"-placement":       "Write replication documents to the target's (pull, default) or the source's (push) _replicator",
+						"-replicator-db":   "Database replication documents are written to (default: _replicator)",
+						"-rep-options":     "Replication options as KEY=VALUE or DATABASE:KEY=VALUE (comma-separated)",
+						"-rep-template":    "JSON file with extra fields added to every replication document",
+						"-redaction-rules": "JSON file with the fields to drop from documents replicated into each restricted region",
+						"-foreground":      "Keep running the continuous replications the plugin runs itself (local-only and redacted) until Ctrl-C",
+						"-policy":          "File listing the regions each database may exist in or be replicated into",
+						"-api-keys":        "Use a new API key for each replication instead of the account credentials"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-graph",
+				HelpText: "outputs the replications of an app's Cloudant databases as a Graphviz or Mermaid diagram",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-graph [-a APP] [-p PASSWORD] [--format dot|mermaid] [-o FILE] [--replicator-db NAME]\n",
+					Options: map[string]string{
+						"a":              "App name",
+						"p":              "Password",
+						"o":              "File to write the diagram to (default: print it)",
+						"-format":        "Diagram format: 'dot' (default) or 'mermaid'",
+						"-replicator-db": "Database replication documents are read from (default: _replicator)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-sample",
+				HelpText: "copies a reproducible sample of the documents of Cloudant databases from one region or app to another",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-sample --from REGION --to REGION -d DATABASE (--percent P | --count N) [--seed SEED] [--ref-fields FIELDS] [--to-app APP] [-a APP] [-p PASSWORD] [--create] [--redaction-rules FILE] [--policy FILE]\n",
+					Options: map[string]string{
+						"a":                "App name of the source",
+						"d":                "Database to sample (repeatable)",
+						"p":                "Password",
+						"-from":            "Region to copy the sample from",
+						"-to":              "Region to copy the sample to",
+						"-to-app":          "App bound to the Cloudant service to copy the sample to (default: the source app)",
+						"-percent":         "Percentage of the documents to copy",
+						"-count":           "Number of documents to copy",
+						"-seed":            "Value that selects the sample; the same seed gives the same sample",
+						"-ref-fields":      "Fields holding the IDs of referenced documents that are copied along (comma-separated)",
+						"-create":          "Create the databases in the target if they don't exist",
+						"-redaction-rules": "JSON file with the fields to drop from documents copied into each restricted region",
+						"-policy":          "File listing the regions each database may exist in or be copied into"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-restore-security",
+				HelpText: "puts back the database permissions saved in a security snapshot in every region",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-restore-security SNAPSHOT [-a APP] [-p PASSWORD]\n",
+					Options: map[string]string{
+						"a": "App name",
+						"p": "Password"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-fence",
+				HelpText: "makes the databases of a region read-only for the app while replication keeps running",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-fence REGION [-a APP] [-d DATABASE] [-p PASSWORD] [--replicator-db NAME]\n",
+					Options: map[string]string{
+						"a":              "App name",
+						"d":              "Database",
+						"p":              "Password",
+						"-replicator-db": "Database replication documents are read from (default: _replicator)"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-unfence",
+				HelpText: "puts back the database permissions a region had before it was fenced",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-unfence REGION [-a APP] [-p PASSWORD]\n",
+					Options: map[string]string{
+						"a": "App name",
+						"p": "Password"},
+				},
+			},
+			plugin.Command{
+				Name:     "cloudant-access-report",
+				HelpText: "shows the roles every user holds on each database in every region",
+				UsageDetails: plugin.Usage{
+					Usage: "cf cloudant-access-report [-a APP] [-d DATABASE] [-p PASSWORD] [--replicator-db NAME]\n",
 					Options: map[string]string{
-						"a":        "App name",
-						"d":        "Database names to replicate (comma-separated)",
-						"-all-dbs": "Select all databases",
-						"-create":  "Create non-existing databases",
-						"p":        "Password"},
+						"a":              "App name",
+						"d":              "Database",
+						"p":              "Password",
+						"-replicator-db": "Database replication documents are read from (default: _replicator)"},
 				},
 			},
 		},
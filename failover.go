@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"sort"
+)
+
+/*
+*	Makes the region passed with --to the write primary. The
+*	replications going out of the old primary are deleted from every
+*	reachable region and replaced by replications from the new
+*	primary to every other reachable region. The old primary does not
+*	have to be reachable: with pull placement its outgoing replication
+*	documents live in the replicas.
+*
+*	The new replications get no since_seq. The checkpoints of the old
+*	replications are sequences of the old primary's databases and
+*	say nothing about how far a replica is behind the new primary, so
+*	starting from one could skip changes the replica never got. The
+*	replicator still resumes a new replication from its own latest
+*	checkpoint when the same replication ran before, e.g. when failing
+*	back to an earlier primary.
+ */
+func failover(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if flags.To == "" {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the region to promote with '" + terminal.ColorizeBold("--to", 33) +
+			"'. For help look to '" + terminal.ColorizeBold("cf help cloudant-failover", 33) + "'"))
+	}
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	restore := getFinalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	defer restore()
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	template, err := getReplicationTemplate(flags)
+	bcr_utils.CheckErrorFatal(err)
+	rules, err := readRedactionRules(flags.RedactionRules, cloudantAccounts)
+	bcr_utils.CheckErrorFatal(err)
+	policy, err := readPolicy(flags.Policy)
+	bcr_utils.CheckErrorFatal(err)
+	newPrimary, found := bcr_utils.FindAccount(flags.To, cloudantAccounts)
+	if !found {
+		bcr_utils.CheckErrorFatal(errors.New("No Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
+			"' in region '" + terminal.ColorizeBold(flags.To, 36) + "'"))
+	}
+	fmt.Println("\nReading the existing replications\n")
+	all_docs := getAllReplicationDocuments(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	var oldPrimaries []string
+	if flags.From != "" {
+		oldPrimary, found := bcr_utils.FindAccount(flags.From, cloudantAccounts)
+		if found {
+			oldPrimaries = append(oldPrimaries, oldPrimary.Username)
+		} else {
+			fmt.Println(terminal.ColorizeBold("WARNING", 33) + ": '" + terminal.ColorizeBold(flags.From, 36) +
+				"' can't be reached, looking for its replications in the other regions\n")
+		}
+	}
+	if len(oldPrimaries) == 0 {
+		for i := 0; i < len(all_docs); i++ {
+			if all_docs[i].TargetAccount == newPrimary.Username && all_docs[i].SourceAccount != newPrimary.Username &&
+				!bcr_utils.IsValid(all_docs[i].SourceAccount, oldPrimaries) {
+				oldPrimaries = append(oldPrimaries, all_docs[i].SourceAccount)
+			}
+		}
+	}
+	if len(oldPrimaries) == 0 {
+		bcr_utils.CheckErrorFatal(errors.New("No region replicating into '" + terminal.ColorizeBold(newPrimary.Endpoint, 36) +
+			"' was found. Pass the current primary with '" + terminal.ColorizeBold("--from", 33) + "'"))
+	}
+	var docs []ReplicationDocument
+	dbs := flags.Dbs
+	for i := 0; i < len(all_docs); i++ {
+		if bcr_utils.IsValid(all_docs[i].SourceAccount, oldPrimaries) &&
+			(len(flags.Dbs) == 0 || bcr_utils.IsValid(all_docs[i].SourceDb, flags.Dbs)) {
+			docs = append(docs, all_docs[i])
+			if !bcr_utils.IsValid(all_docs[i].SourceDb, dbs) {
+				dbs = append(dbs, all_docs[i].SourceDb)
+			}
+		}
+	}
+	sort.Strings(dbs)
+	var replicas []cam.CloudantAccount
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if cloudantAccounts[i].Username != newPrimary.Username {
+			replicas = append(replicas, cloudantAccounts[i])
+		}
+	}
+	var replications []Replication
+	for i := 0; i < len(replicas); i++ {
+		replications = append(replications, Replication{Source: newPrimary, Target: replicas[i]})
+	}
+	var violations []string
+	for i := 0; i < len(dbs); i++ {
+		violations = append(violations, getPolicyViolations(policy, dbs[i], nil, cloudantAccounts, replications, flags.Placement)...)
+	}
+	enforcePolicy(violations, flags.Policy)
+	var unreachable []string
+	if flags.Placement == "push" {
+		unreachable = getUnreachableAccounts(httpClient, oldPrimaries, cloudantAccounts, flags.ReplicatorDb)
+	}
+	deleteReplicationDocuments(httpClient, docs, flags.ReplicatorDb)
+	unredacted := deleteUnredactedReplications(httpClient, cloudantAccounts, rules, dbs, flags.ReplicatorDb)
+	var results []ReplicationResult
+	pending := make(map[string][]Replication)
+	redacted := make(map[string][]Replication)
+	for i := 0; i < len(dbs); i++ {
+		if r := getRedactedReplications(replications, rules); len(r) > 0 {
+			redacted[dbs[i]] = r
+		}
+		dbResults, _ := linkDatabase(dbs[i], httpClient, cloudantAccounts, replications, flags, template, rules, pending, nil)
+		results = append(results, dbResults...)
+	}
+	deleteCookies(httpClient, cloudantAccounts)
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\n'" + terminal.ColorizeBold(newPrimary.Endpoint, 36) + "' is now the primary of '" +
+		terminal.ColorizeBold(appname, 36) + "' and replicates to:\n")
+	for i := 0; i < len(replicas); i++ {
+		fmt.Println(terminal.ColorizeBold(replicas[i].Endpoint, 36))
+	}
+	fmt.Println("\nDeleted replication documents of the old primary:\n")
+	for i := 0; i < len(docs); i++ {
+		fmt.Println(terminal.ColorizeBold(docs[i].Id, 36) + " in " + docs[i].Owner.Endpoint)
+	}
+	fmt.Println("\nFailed over databases:\n")
+	for i := 0; i < len(dbs); i++ {
+		fmt.Println(terminal.ColorizeBold(dbs[i], 36))
+	}
+	printUnreachablePrimaries(unreachable, dbs, cloudantAccounts, flags.ReplicatorDb)
+	fmt.Println("\nThe new replications resume from their own checkpoint if they ran before, and otherwise compare every " +
+		"document from the start of each database, as the old primary's checkpoints can't be used for the new primary. " +
+		"Only missing revisions are copied.")
+	printLocalResults(results)
+	printRedactedReplications(dbs, redacted, rules, unredacted)
+	printSecuritySnapshot()
+	runContinuousLocalReplications(httpClient, pending, flags, template, rules, restore)
+}
+
+/*
+*	Returns the usernames of the old primaries whose replicator
+*	database can't be read. With push placement the replication
+*	documents they push from can't be deleted.
+ */
+func getUnreachableAccounts(httpClient *http.Client, usernames []string, cloudantAccounts []cam.CloudantAccount, replicatorDb string) []string {
+	var unreachable []string
+	for i := 0; i < len(usernames); i++ {
+		account, found := findAccountByUsername(usernames[i], cloudantAccounts)
+		if found {
+			if _, err := getReplicationDocuments(httpClient, account, replicatorDb); err == nil {
+				continue
+			}
+		}
+		unreachable = append(unreachable, usernames[i])
+	}
+	return unreachable
+}
+
+/*
+*	Warns about the old primaries whose replication documents could
+*	not be deleted. With push placement they live in the old primary
+*	and resume writing into the replicas once it is back, next to the
+*	new primary.
+ */
+func printUnreachablePrimaries(unreachable []string, dbs []string, cloudantAccounts []cam.CloudantAccount, replicatorDb string) {
+	for i := 0; i < len(unreachable); i++ {
+		fmt.Println("\n" + terminal.ColorizeBold("WARNING", 33) + ": '" + terminal.ColorizeBold(replicatorDb, 36) + "' of the old primary '" +
+			terminal.ColorizeBold(unreachable[i], 36) + "' could not be read, so replication documents it pushes from were not deleted. " +
+			"When it comes back it will keep writing into the replicas next to the new primary. Delete them from it before then:\n")
+		for j := 0; j < len(dbs); j++ {
+			for k := 0; k < len(cloudantAccounts); k++ {
+				if cloudantAccounts[k].Username != unreachable[i] {
+					fmt.Println(terminal.ColorizeBold(dbs[j]+"-"+cloudantAccounts[k].Username, 36))
+				}
+			}
+		}
+		if len(dbs) == 0 {
+			fmt.Println("every document in '" + replicatorDb + "' replicating out of '" + unreachable[i] + "'")
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var fenceMutex sync.Mutex
+
+/*
+*	Makes the databases of a region read-only for the usernames in
+*	their cloudant sections, e.g. API keys. Every one keeps at most
+*	_reader, except the identities replicating into and out of the
+*	region. The account's own credentials are not restricted by the
+*	cloudant section, so an app writing with them is not fenced. The
+*	permissions as they were are saved to the fence file of the region,
+*	which cloudant-unfence puts back.
+ */
+func fence(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if len(flags.Args) != 1 {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the region to fence. For help look to '" +
+			terminal.ColorizeBold("cf help cloudant-fence", 33) + "'"))
+	}
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	account := findFenceAccount(flags.Args[0], appname, cloudantAccounts)
+	fenceFile := getFenceFile(account)
+	if _, err := os.Stat(fenceFile); err == nil {
+		bcr_utils.CheckErrorFatal(errors.New("'" + terminal.ColorizeBold(account.Endpoint, 36) + "' is already fenced. Run '" +
+			terminal.ColorizeBold("cf cloudant-unfence "+flags.Args[0], 33) + "' first"))
+	}
+	dbs := flags.Dbs
+	if len(dbs) == 0 {
+		all_dbs := bcr_utils.GetDatabases(httpClient, account)
+		for i := 0; i < len(all_dbs); i++ {
+			if !strings.HasPrefix(all_dbs[i], "_") && all_dbs[i] != flags.ReplicatorDb {
+				dbs = append(dbs, all_dbs[i])
+			}
+		}
+	}
+	fmt.Println("\nReading the existing replications\n")
+	docs := getAllReplicationDocuments(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	identities := getReplicationIdentities(account, cloudantAccounts, docs)
+	fmt.Println("\nFencing databases in '" + terminal.ColorizeBold(account.Endpoint, 36) + "'\n")
+	type fenceResult struct {
+		Line   string
+		Fenced bool
+	}
+	responses := make(chan bcr_utils.HttpResponse)
+	result_ch := make(chan fenceResult)
+	for i := 0; i < len(dbs); i++ {
+		go func(httpClient *http.Client, account cam.CloudantAccount, db string) {
+			line := terminal.ColorizeBold(db, 36)
+			sec, r := getSecurity(db, httpClient, account)
+			split_status := strings.Split(r.Status, " ")[0]
+			status, _ := strconv.Atoi(split_status)
+			if status != 200 || r.Err != nil {
+				r.Err = errors.New("Unable to read the permissions of '" + line + "' in '" +
+					terminal.ColorizeBold(account.Endpoint, 36) + "'")
+				responses <- r
+				result_ch <- fenceResult{}
+				return
+			}
+			if sec.Model == "couchdb" {
+				responses <- r
+				result_ch <- fenceResult{Line: line + " uses CouchDB-style admins and members, which have no read-only role"}
+				return
+			}
+			body := sec.Body
+			if !fenceSecurity(sec, account.Username, identities) {
+				responses <- r
+				result_ch <- fenceResult{Line: line + " already gives no write access", Fenced: true}
+				return
+			}
+			fenceMutex.Lock()
+			err := appendSecurityEntry(fenceFile, account, db, sec.Model, body)
+			fenceMutex.Unlock()
+			if err != nil {
+				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Err: err}
+				result_ch <- fenceResult{}
+				return
+			}
+			r = putSecurity(sec, db, httpClient, account)
+			responses <- r
+			result_ch <- fenceResult{Line: line, Fenced: r.Err == nil}
+		}(httpClient, account, dbs[i])
+	}
+	bcr_utils.CheckHttpResponses(responses, len(dbs))
+	close(responses)
+	var fenced, skipped []string
+	for i := 0; i < len(dbs); i++ {
+		result := <-result_ch
+		if result.Fenced {
+			fenced = append(fenced, result.Line)
+		} else if result.Line != "" {
+			skipped = append(skipped, result.Line)
+		}
+	}
+	close(result_ch)
+	sort.Strings(fenced)
+	sort.Strings(skipped)
+	deleteCookies(httpClient, cloudantAccounts)
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\nFenced databases in '" + terminal.ColorizeBold(account.Endpoint, 36) + "':\n")
+	for i := 0; i < len(fenced); i++ {
+		fmt.Println(fenced[i])
+	}
+	if len(skipped) > 0 {
+		fmt.Println("\nNot fenced:\n")
+		for i := 0; i < len(skipped); i++ {
+			fmt.Println(skipped[i])
+		}
+	}
+	if len(identities) > 0 {
+		fmt.Println("\nKept the access of the replication identities:\n")
+		for i := 0; i < len(identities); i++ {
+			fmt.Println(identities[i])
+		}
+	}
+	fmt.Println("\n" + terminal.ColorizeBold("WARNING", 33) + ": only the API keys and users in the permissions were fenced. " +
+		"The account credentials of '" + terminal.ColorizeBold(account.Endpoint, 36) + "' are not restricted by them, so an app " +
+		"bound to the service can still write with those. Give the app an API key to fence it as well.")
+	if _, err := os.Stat(fenceFile); err == nil {
+		fmt.Println("\nThe original permissions were saved to '" + terminal.ColorizeBold(fenceFile, 36) +
+			"'. Restore them with '" + terminal.ColorizeBold("cf cloudant-unfence "+flags.Args[0], 33) + "'")
+	}
+}
+
+/*
+*	Puts back the permissions saved by cloudant-fence for a region and
+*	deletes its fence file once every database was restored
+ */
+func unfence(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if len(flags.Args) != 1 {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the region to unfence. For help look to '" +
+			terminal.ColorizeBold("cf help cloudant-unfence", 33) + "'"))
+	}
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	account := findFenceAccount(flags.Args[0], appname, cloudantAccounts)
+	fenceFile := getFenceFile(account)
+	if _, err := os.Stat(fenceFile); err != nil {
+		bcr_utils.CheckErrorFatal(errors.New("'" + terminal.ColorizeBold(account.Endpoint, 36) + "' is not fenced, '" +
+			terminal.ColorizeBold(fenceFile, 36) + "' was not found"))
+	}
+	entries, err := readSecuritySnapshot(fenceFile)
+	bcr_utils.CheckErrorFatal(err)
+	restored, skipped := restoreSecurityEntries(httpClient, cloudantAccounts, entries)
+	deleteCookies(httpClient, cloudantAccounts)
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\nRestored the permissions of:\n")
+	for i := 0; i < len(restored); i++ {
+		fmt.Println(restored[i])
+	}
+	if len(restored) == len(entries) {
+		if bcr_utils.CheckErrorNonFatal(os.Remove(fenceFile)) {
+			fmt.Println("\nDelete '" + terminal.ColorizeBold(fenceFile, 36) + "' before fencing the region again")
+		} else {
+			fmt.Println("\n'" + terminal.ColorizeBold(account.Endpoint, 36) + "' is no longer fenced")
+		}
+	} else {
+		if len(skipped) > 0 {
+			fmt.Println("\nSkipped, no Cloudant service of '" + terminal.ColorizeBold(appname, 36) + "' was found for the account:\n")
+			for i := 0; i < len(skipped); i++ {
+				fmt.Println(skipped[i])
+			}
+		}
+		fmt.Println("\n" + terminal.ColorizeBold("WARNING", 33) + ": not every database was restored, '" +
+			terminal.ColorizeBold(fenceFile, 36) + "' was kept. Run '" +
+			terminal.ColorizeBold("cf cloudant-unfence "+flags.Args[0], 33) + "' again")
+	}
+	printSecuritySnapshot()
+}
+
+/*
+*	Returns the account of the app in region
+ */
+func findFenceAccount(region string, appname string, cloudantAccounts []cam.CloudantAccount) cam.CloudantAccount {
+	account, found := bcr_utils.FindAccount(region, cloudantAccounts)
+	if !found {
+		bcr_utils.CheckErrorFatal(errors.New("No Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
+			"' in region '" + terminal.ColorizeBold(region, 36) + "'"))
+	}
+	return account
+}
+
+/*
+*	The file holding the permissions of a fenced region as they were
+*	before it was fenced
+ */
+func getFenceFile(account cam.CloudantAccount) string {
+	return "fence-" + account.Username + ".jsonl"
+}
+
+/*
+*	Returns the usernames that replicate into or out of account and
+*	have to keep their access when it is fenced: the other regions of
+*	the app and the credentials found in replication documents. The
+*	account's own username is left out, as it isn't fenced.
+ */
+func getReplicationIdentities(account cam.CloudantAccount, cloudantAccounts []cam.CloudantAccount, docs []ReplicationDocument) []string {
+	var identities []string
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if cloudantAccounts[i].Username != account.Username {
+			identities = append(identities, cloudantAccounts[i].Username)
+		}
+	}
+	for i := 0; i < len(docs); i++ {
+		var credentials []string
+		if docs[i].SourceAccount == account.Username {
+			credentials = append(credentials, getReplicationCredential(docs[i].Doc["source"]))
+		}
+		if docs[i].TargetAccount == account.Username {
+			credentials = append(credentials, getReplicationCredential(docs[i].Doc["target"]))
+		}
+		for j := 0; j < len(credentials); j++ {
+			if credentials[j] != "" && credentials[j] != account.Username && !bcr_utils.IsValid(credentials[j], identities) {
+				identities = append(identities, credentials[j])
+			}
+		}
+	}
+	sort.Strings(identities)
+	return identities
+}
+
+/*
+*	Leaves every username in the cloudant section that isn't one of
+*	identities with at most _reader. The owner of the database is left
+*	alone, since the cloudant section doesn't restrict its credentials.
+*	Returns whether the document changed.
+ */
+func fenceSecurity(sec Security, owner string, identities []string) bool {
+	cloudant := getCloudantSection(sec)
+	changed := false
+	for username, roles := range getGrantees(sec) {
+		if bcr_utils.IsValid(username, identities) || username == owner {
+			continue
+		}
+		fenced := []string{}
+		if bcr_utils.IsValid("_reader", roles) {
+			fenced = append(fenced, "_reader")
+		}
+		if len(fenced) != len(roles) {
+			cloudant[username] = fenced
+			changed = true
+		}
+	}
+	return changed
+}
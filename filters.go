@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+*	Checks that a replication document uses at most one of a filter
+*	function, a selector and a list of doc_ids, since the replicator
+*	only honours one of them
+ */
+func validateReplicationFilters(rep map[string]interface{}) error {
+	var used []string
+	if rep["filter"] != nil {
+		used = append(used, "filter")
+	}
+	if rep["selector"] != nil {
+		used = append(used, "selector")
+	}
+	if rep["doc_ids"] != nil {
+		used = append(used, "doc_ids")
+	}
+	if len(used) > 1 {
+		return errors.New("Replication " + rep["_id"].(string) + " can only use one of " + strings.Join(used, ", "))
+	}
+	return nil
+}
+
+/*
+*	Checks that the filter function named by a replication document
+*	("DESIGN_DOC/FILTER") exists in the source database
+ */
+func checkFilterExists(httpClient *http.Client, source cam.CloudantAccount, db string, filter string) error {
+	split_filter := strings.SplitN(filter, "/", 2)
+	if len(split_filter) != 2 {
+		return errors.New("Invalid filter '" + filter + "'. Use DESIGN_DOC/FILTER")
+	}
+	notFound := errors.New("Filter '" + terminal.ColorizeBold(filter, 36) + "' does not exist in '" +
+		terminal.ColorizeBold(db, 36) + "' at '" + terminal.ColorizeBold(source.Endpoint, 36) + "'")
+	ddocUrl := "https://" + source.Username + ".cloudant.com/" + db + "/_design/" + url.PathEscape(split_filter[0])
+	headers := map[string]string{"Cookie": source.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", ddocUrl, "", headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 {
+		return notFound
+	}
+	var ddoc struct {
+		Filters map[string]interface{} `json:"filters"`
+	}
+	json.Unmarshal(respBody, &ddoc)
+	if ddoc.Filters[split_filter[1]] == nil {
+		return notFound
+	}
+	return nil
+}
+
+/*
+*	Makes a replication document skip design documents ("skip") or
+*	replicate nothing but design documents ("only"). Design document
+*	IDs are the only ones starting with "_design/", so they sort
+*	between "_design/" and "_design0".
+ */
+func applyDesignDocOption(rep map[string]interface{}, designDocs string) error {
+	if designDocs == "" {
+		return nil
+	}
+	if rep["filter"] != nil {
+		return errors.New("Replication " + rep["_id"].(string) + " uses a filter function, which can't be combined with '" +
+			terminal.ColorizeBold("--"+designDocs+"-design-docs", 33) + "'")
+	}
+	if docIds, ok := rep["doc_ids"].([]interface{}); ok {
+		var kept []interface{}
+		for i := 0; i < len(docIds); i++ {
+			id, _ := docIds[i].(string)
+			if strings.HasPrefix(id, "_design/") == (designDocs == "only") {
+				kept = append(kept, docIds[i])
+			}
+		}
+		if len(kept) == 0 {
+			return errors.New("None of the doc_ids of replication " + rep["_id"].(string) + " are left after applying '" +
+				terminal.ColorizeBold("--"+designDocs+"-design-docs", 33) + "'")
+		}
+		rep["doc_ids"] = kept
+		return nil
+	}
+	if designDocs == "only" {
+		addSelector(rep, map[string]interface{}{"_id": map[string]interface{}{"$gte": "_design/", "$lt": "_design0"}})
+	} else {
+		addSelector(rep, map[string]interface{}{"$or": []interface{}{
+			map[string]interface{}{"_id": map[string]interface{}{"$lt": "_design/"}},
+			map[string]interface{}{"_id": map[string]interface{}{"$gte": "_design0"}}}})
+	}
+	return nil
+}
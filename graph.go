@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+*	Matches the suffix shardReplicationDocument adds to the _id of
+*	each slice of a sharded replication
+ */
+var SHARD_SUFFIX = regexp.MustCompile(`-shard-[0-9]+-of-([0-9]+)$`)
+
+/*
+*	One edge of the replication diagram. Slices of a sharded
+*	replication are drawn as a single edge.
+ */
+type GraphEdge struct {
+	Source string
+	Target string
+	Label  string
+}
+
+/*
+*	Reads the replication documents of every account and outputs the
+*	replications as a Graphviz (dot) or Mermaid diagram. Nodes are
+*	region/database and edges are labelled with the kind of
+*	replication and its current state.
+ */
+func graph(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if flags.Format == "" {
+		flags.Format = "dot"
+	}
+	if flags.Format != "dot" && flags.Format != "mermaid" {
+		bcr_utils.CheckErrorFatal(errors.New("Unknown format '" + flags.Format + "'. Use '" +
+			terminal.ColorizeBold("dot", 33) + "' or '" + terminal.ColorizeBold("mermaid", 33) + "'"))
+	}
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	fmt.Println("\nReading the existing replications\n")
+	docs := getAllReplicationDocuments(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	states := getAllSchedulerStates(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	deleteCookies(httpClient, cloudantAccounts)
+	edges := getGraphEdges(docs, states, cloudantAccounts)
+	var diagram string
+	if flags.Format == "mermaid" {
+		diagram = toMermaid(edges)
+	} else {
+		diagram = toDot(edges)
+	}
+	if flags.Output != "" {
+		err = ioutil.WriteFile(flags.Output, []byte(diagram), 0644)
+		bcr_utils.CheckErrorFatal(err)
+		fmt.Println("\nWrote " + strconv.Itoa(len(edges)) + " replications to '" + terminal.ColorizeBold(flags.Output, 36) + "'")
+	} else {
+		fmt.Println(terminal.ColorizeBold("\nDIAGRAM", 35) + "\n")
+		fmt.Print(diagram)
+	}
+}
+
+/*
+*	Number of entries read per request from the replication scheduler
+ */
+var SCHEDULER_PAGE_SIZE = 1000
+
+/*
+*	Reads the state of every replication in account's replicator
+*	database from the replication scheduler, keyed by document _id
+ */
+func getSchedulerStates(httpClient *http.Client, account cam.CloudantAccount, replicatorDb string) (map[string]string, error) {
+	states := make(map[string]string)
+	headers := map[string]string{"Cookie": account.Cookie}
+	for skip := 0; ; skip += SCHEDULER_PAGE_SIZE {
+		schedulerUrl := "https://" + account.Username + ".cloudant.com/_scheduler/docs/" + url.PathEscape(replicatorDb) +
+			"?limit=" + strconv.Itoa(SCHEDULER_PAGE_SIZE) + "&skip=" + strconv.Itoa(skip)
+		resp, err := bcr_utils.MakeRequest(httpClient, "GET", schedulerUrl, "", headers)
+		if err != nil {
+			return states, err
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		split_status := strings.Split(resp.Status, " ")[0]
+		status, _ := strconv.Atoi(split_status)
+		if status != 200 {
+			return states, errors.New("Unable to read the replication scheduler of '" + terminal.ColorizeBold(account.Endpoint, 36) + "'")
+		}
+		var page struct {
+			Docs []struct {
+				DocId string `json:"doc_id"`
+				State string `json:"state"`
+			} `json:"docs"`
+		}
+		json.Unmarshal(respBody, &page)
+		for i := 0; i < len(page.Docs); i++ {
+			states[page.Docs[i].DocId] = page.Docs[i].State
+		}
+		if len(page.Docs) < SCHEDULER_PAGE_SIZE {
+			return states, nil
+		}
+	}
+}
+
+/*
+*	Reads the scheduler states of every account, keyed by account
+*	username. Accounts whose scheduler can't be read have no entry.
+ */
+func getAllSchedulerStates(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, replicatorDb string) map[string]map[string]string {
+	all_states := make(map[string]map[string]string)
+	type schedulerResult struct {
+		Username string
+		States   map[string]string
+		Err      error
+	}
+	result_ch := make(chan schedulerResult)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(httpClient *http.Client, account cam.CloudantAccount) {
+			states, err := getSchedulerStates(httpClient, account, replicatorDb)
+			result_ch <- schedulerResult{Username: account.Username, States: states, Err: err}
+		}(httpClient, cloudantAccounts[i])
+	}
+	for i := 0; i < len(cloudantAccounts); i++ {
+		result := <-result_ch
+		if result.Err == nil {
+			all_states[result.Username] = result.States
+		}
+	}
+	close(result_ch)
+	return all_states
+}
+
+/*
+*	Replication states from worst to best. A merged edge lists the
+*	states of its slices in this order; states not in the list come
+*	first.
+ */
+var STATE_ORDER = []string{"failed", "crashing", "error", "unknown", "pending", "initializing", "triggered", "running", "completed"}
+
+/*
+*	Turns replication documents into diagram edges, merging the
+*	slices of sharded replications. The state of each replication is
+*	taken from states, and from its replication document only when
+*	the scheduler of its account couldn't be read. A merged edge
+*	counts how many of its slices are in each state.
+ */
+func getGraphEdges(docs []ReplicationDocument, states map[string]map[string]string, cloudantAccounts []cam.CloudantAccount) []GraphEdge {
+	type edgeGroup struct {
+		Doc    ReplicationDocument
+		Kind   string
+		Counts map[string]int
+	}
+	var keys []string
+	groups := make(map[string]*edgeGroup)
+	for i := 0; i < len(docs); i++ {
+		kind := "one-shot"
+		if docs[i].Continuous {
+			kind = "continuous"
+		}
+		key := docs[i].Owner.Username + "/" + docs[i].Id
+		match := SHARD_SUFFIX.FindStringSubmatch(docs[i].Id)
+		if match != nil {
+			key = docs[i].Owner.Username + "/" + SHARD_SUFFIX.ReplaceAllString(docs[i].Id, "")
+			kind += ", " + match[1] + " shards"
+		}
+		state := docs[i].State
+		if accountStates, found := states[docs[i].Owner.Username]; found {
+			state = accountStates[docs[i].Id]
+		}
+		if state == "" {
+			state = "unknown"
+		}
+		group, found := groups[key]
+		if !found {
+			group = &edgeGroup{Doc: docs[i], Kind: kind, Counts: make(map[string]int)}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		group.Counts[state]++
+	}
+	var edges []GraphEdge
+	for i := 0; i < len(keys); i++ {
+		group := groups[keys[i]]
+		edges = append(edges, GraphEdge{
+			Source: getGraphNode(group.Doc.SourceAccount, group.Doc.SourceDb, cloudantAccounts),
+			Target: getGraphNode(group.Doc.TargetAccount, group.Doc.TargetDb, cloudantAccounts),
+			Label:  group.Kind + ", " + getStateLabel(group.Counts)})
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Source != edges[j].Source {
+			return edges[i].Source < edges[j].Source
+		}
+		if edges[i].Target != edges[j].Target {
+			return edges[i].Target < edges[j].Target
+		}
+		return edges[i].Label < edges[j].Label
+	})
+	return edges
+}
+
+/*
+*	Describes the states of the slices of a replication, worst first.
+*	A single state is named on its own, several are counted, e.g.
+*	"1 failed, 3 running".
+ */
+func getStateLabel(counts map[string]int) string {
+	var names []string
+	for state := range counts {
+		names = append(names, state)
+	}
+	rank := func(state string) int {
+		for i := 0; i < len(STATE_ORDER); i++ {
+			if STATE_ORDER[i] == state {
+				return i
+			}
+		}
+		return -1
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if rank(names[i]) != rank(names[j]) {
+			return rank(names[i]) < rank(names[j])
+		}
+		return names[i] < names[j]
+	})
+	if len(names) == 1 {
+		return names[0]
+	}
+	parts := make([]string, len(names))
+	for i := 0; i < len(names); i++ {
+		parts[i] = strconv.Itoa(counts[names[i]]) + " " + names[i]
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+*	Names a node region/database. Accounts that were not discovered
+*	are named by their username instead of their region.
+ */
+func getGraphNode(username string, db string, cloudantAccounts []cam.CloudantAccount) string {
+	account, found := findAccountByUsername(username, cloudantAccounts)
+	if found {
+		return bcr_utils.GetRegion(account.Endpoint) + "/" + db
+	}
+	return username + "/" + db
+}
+
+func toDot(edges []GraphEdge) string {
+	lines := []string{"digraph replication {", "\trankdir=LR;"}
+	for i := 0; i < len(edges); i++ {
+		lines = append(lines, "\t"+strconv.Quote(edges[i].Source)+" -> "+strconv.Quote(edges[i].Target)+
+			" [label="+strconv.Quote(edges[i].Label)+"];")
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func toMermaid(edges []GraphEdge) string {
+	lines := []string{"graph LR"}
+	nodes := make(map[string]string)
+	nodeId := func(name string) string {
+		if id, found := nodes[name]; found {
+			return id
+		}
+		nodes[name] = "n" + strconv.Itoa(len(nodes))
+		return nodes[name] + "[\"" + name + "\"]"
+	}
+	for i := 0; i < len(edges); i++ {
+		lines = append(lines, "\t"+nodeId(edges[i].Source)+" -->|"+edges[i].Label+"| "+nodeId(edges[i].Target))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"testing"
+)
+
+var graphAccounts = []cam.CloudantAccount{
+	{Username: "acct-ng", Endpoint: "https://api.ng.bluemix.net"},
+	{Username: "acct-eu", Endpoint: "https://api.eu-gb.bluemix.net"},
+}
+
+func graphDoc(id string, continuous bool, state string) ReplicationDocument {
+	return ReplicationDocument{Id: id, Owner: graphAccounts[0], SourceAccount: "acct-ng", SourceDb: "orders",
+		TargetAccount: "acct-eu", TargetDb: "orders", Continuous: continuous, State: state}
+}
+
+func TestGetGraphEdges(t *testing.T) {
+	tests := []struct {
+		name   string
+		docs   []ReplicationDocument
+		states map[string]map[string]string
+		labels []string
+	}{
+		{"one-shot from the document", []ReplicationDocument{graphDoc("a", false, "completed")},
+			map[string]map[string]string{}, []string{"one-shot, completed"}},
+		{"scheduler wins over the document", []ReplicationDocument{graphDoc("a", true, "triggered")},
+			map[string]map[string]string{"acct-ng": {"a": "crashing"}}, []string{"continuous, crashing"}},
+		{"no state is unknown", []ReplicationDocument{graphDoc("a", true, "")},
+			map[string]map[string]string{}, []string{"continuous, unknown"}},
+		{"shards in one state", []ReplicationDocument{graphDoc("a-shard-1-of-2", true, "running"), graphDoc("a-shard-2-of-2", true, "running")},
+			map[string]map[string]string{}, []string{"continuous, 2 shards, running"}},
+		{"shards count states worst first", []ReplicationDocument{graphDoc("a-shard-1-of-4", true, ""), graphDoc("a-shard-2-of-4", true, ""),
+			graphDoc("a-shard-3-of-4", true, ""), graphDoc("a-shard-4-of-4", true, "")},
+			map[string]map[string]string{"acct-ng": {"a-shard-1-of-4": "running", "a-shard-2-of-4": "failed",
+				"a-shard-3-of-4": "running", "a-shard-4-of-4": "pending"}},
+			[]string{"continuous, 4 shards, 1 failed, 1 pending, 2 running"}},
+		{"different replications stay apart", []ReplicationDocument{graphDoc("a-shard-1-of-2", true, "running"), graphDoc("b", false, "completed")},
+			map[string]map[string]string{}, []string{"continuous, 2 shards, running", "one-shot, completed"}},
+	}
+	for i := 0; i < len(tests); i++ {
+		edges := getGraphEdges(tests[i].docs, tests[i].states, graphAccounts)
+		if len(edges) != len(tests[i].labels) {
+			t.Fatalf("%s: expected %d edges, got %v", tests[i].name, len(tests[i].labels), edges)
+		}
+		for j := 0; j < len(edges); j++ {
+			if edges[j].Source != "ng/orders" || edges[j].Target != "eu-gb/orders" {
+				t.Fatalf("%s: expected ng/orders -> eu-gb/orders, got %s -> %s", tests[i].name, edges[j].Source, edges[j].Target)
+			}
+			if edges[j].Label != tests[i].labels[j] {
+				t.Fatalf("%s: expected label %q, got %q", tests[i].name, tests[i].labels[j], edges[j].Label)
+			}
+		}
+	}
+}
+
+func TestGetGraphNodeOfUnknownAccount(t *testing.T) {
+	if node := getGraphNode("other", "orders", graphAccounts); node != "other/orders" {
+		t.Fatalf("expected other/orders, got %s", node)
+	}
+}
+
+func TestDiagrams(t *testing.T) {
+	edges := []GraphEdge{
+		{Source: "ng/orders", Target: "eu-gb/orders", Label: "continuous, running"},
+		{Source: "eu-gb/orders", Target: "ng/orders", Label: "one-shot, completed"},
+	}
+	tests := []struct {
+		name     string
+		diagram  func([]GraphEdge) string
+		edges    []GraphEdge
+		expected string
+	}{
+		{"dot", toDot, edges, "digraph replication {\n\trankdir=LR;\n" +
+			"\t\"ng/orders\" -> \"eu-gb/orders\" [label=\"continuous, running\"];\n" +
+			"\t\"eu-gb/orders\" -> \"ng/orders\" [label=\"one-shot, completed\"];\n}\n"},
+		{"empty dot", toDot, nil, "digraph replication {\n\trankdir=LR;\n}\n"},
+		{"mermaid", toMermaid, edges, "graph LR\n" +
+			"\tn0[\"ng/orders\"] -->|continuous, running| n1[\"eu-gb/orders\"]\n" +
+			"\tn1 -->|one-shot, completed| n0\n"},
+		{"empty mermaid", toMermaid, nil, "graph LR\n"},
+	}
+	for i := 0; i < len(tests); i++ {
+		if diagram := tests[i].diagram(tests[i].edges); diagram != tests[i].expected {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", tests[i].name, tests[i].expected, diagram)
+		}
+	}
+}
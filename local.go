@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replicator"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/*
+*	Builds the local-only accounts passed as NAME=URL with
+*	--local-only. NAME takes the place of the region, and of the
+*	username since the account has no Cloudant username.
+ */
+func getLocalAccounts(flags bcr_utils.Flags) ([]cam.CloudantAccount, error) {
+	var localAccounts []cam.CloudantAccount
+	for i := 0; i < len(flags.LocalOnly); i++ {
+		split_arg := strings.SplitN(flags.LocalOnly[i], "=", 2)
+		if len(split_arg) != 2 || split_arg[0] == "" {
+			return localAccounts, errors.New("Invalid local-only endpoint '" + flags.LocalOnly[i] + "'. Use NAME=URL")
+		}
+		parsed, err := url.Parse(split_arg[1])
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return localAccounts, errors.New("Invalid URL for local-only endpoint '" + terminal.ColorizeBold(split_arg[0], 36) + "'")
+		}
+		localAccounts = append(localAccounts, cam.CloudantAccount{Endpoint: split_arg[0], Username: split_arg[0],
+			Url: strings.TrimSuffix(split_arg[1], "/"), LocalOnly: true})
+	}
+	return localAccounts, nil
+}
+
+/*
+*	Returns the accounts that are not local-only
+ */
+func getCloudAccounts(accounts []cam.CloudantAccount) []cam.CloudantAccount {
+	var cloudAccounts []cam.CloudantAccount
+	for i := 0; i < len(accounts); i++ {
+		if !accounts[i].LocalOnly {
+			cloudAccounts = append(cloudAccounts, accounts[i])
+		}
+	}
+	return cloudAccounts
+}
+
+/*
+*	Separates the replications that Cloudant can run from the ones
+*	the plugin has to run itself: those with a local-only end and
+*	those into a region whose documents have to be redacted
+ */
+func splitLocalReplications(replications []Replication, rules map[string]RedactionRule) ([]Replication, []Replication) {
+	var serverReplications, localReplications []Replication
+	for i := 0; i < len(replications); i++ {
+		if replications[i].Source.LocalOnly || replications[i].Target.LocalOnly || isRedacted(replications[i], rules) {
+			localReplications = append(localReplications, replications[i])
+		} else {
+			serverReplications = append(serverReplications, replications[i])
+		}
+	}
+	return serverReplications, localReplications
+}
+
+/*
+*	Links db along replications. Cloudant runs the replications it
+*	can, after the databases are shared along them. Replications the
+*	plugin has to run are run once right away, unless they are
+*	continuous and --foreground was passed: then they are added to
+*	pending to be run once everything is set up.
+*
+*	When replications are all the replications of db, pass the
+*	accounts of the app as known so that grants they no longer need
+*	are removed. Returns the results and the removed grants.
+ */
+func linkDatabase(db string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, replications []Replication, flags bcr_utils.Flags,
+	template ReplicationTemplate, rules map[string]RedactionRule, pending map[string][]Replication, known []cam.CloudantAccount) ([]ReplicationResult, []string) {
+	var results []ReplicationResult
+	serverReplications, localReplications := splitLocalReplications(replications, rules)
+	if flags.ApiKeys && len(serverReplications) > 0 {
+		serverReplications = addApiKeys(httpClient, db, serverReplications, flags)
+	}
+	removed := shareDatabases(db, httpClient, getCloudAccounts(cloudantAccounts), serverReplications, flags, known)
+	if len(serverReplications) > 0 {
+		results = append(results, createReplicationDocuments(db, httpClient, serverReplications, flags, template)...)
+	}
+	if !flags.Once && flags.Foreground && len(localReplications) > 0 {
+		pending[db] = append(pending[db], localReplications...)
+	} else {
+		onceFlags := flags
+		onceFlags.Once = true
+		results = append(results, runLocalReplications(db, httpClient, localReplications, onceFlags, template, rules)...)
+	}
+	return results, removed
+}
+
+/*
+*	Runs the replications of db with the plugin's own replicator and
+*	returns their results. One-shot replications return once they are
+*	done, continuous ones only return when they fail. Documents written
+*	to a region with redaction rules are redacted on the way.
+ */
+func runLocalReplications(db string, httpClient *http.Client, replications []Replication, flags bcr_utils.Flags,
+	template ReplicationTemplate, rules map[string]RedactionRule) []ReplicationResult {
+	var results []ReplicationResult
+	if len(replications) == 0 {
+		return results
+	}
+	if flags.Once {
+		fmt.Println("\nReplicating '" + terminal.ColorizeBold(db, 36) + "' in the plugin\n")
+	}
+	result_ch := make(chan ReplicationResult)
+	for i := 0; i < len(replications); i++ {
+		go func(replication Replication) {
+			result := ReplicationResult{Source: replication.Source.Endpoint, Target: replication.Target.Endpoint, Db: db, Local: true}
+			options, err := getLocalReplicationOptions(db, replication, flags, template)
+			if rule, found := rules[replication.Target.Username]; found {
+				options.Transform = redactDocument(rule)
+			}
+			var r bcr_replicator.Result
+			if err == nil {
+				r, err = bcr_replicator.Replicate(httpClient, getLocalEndpoint(replication.Source, db), getLocalEndpoint(replication.Target, db), options)
+			}
+			result.DocsWritten = r.DocsWritten
+			result.DocWriteFailures = r.DocWriteFailures
+			if err != nil {
+				result.State = "error"
+				result.Reason = err.Error()
+			} else {
+				result.State = "completed"
+			}
+			fmt.Println("Replication of '" + terminal.ColorizeBold(db, 36) + "' from '" +
+				terminal.ColorizeBold(replication.Source.Endpoint, 36) + "' to '" +
+				terminal.ColorizeBold(replication.Target.Endpoint, 36) + "' finished with state '" + result.State + "'")
+			result_ch <- result
+		}(replications[i])
+	}
+	for i := 0; i < len(replications); i++ {
+		results = append(results, <-result_ch)
+	}
+	close(result_ch)
+	return results
+}
+
+/*
+*	Runs the continuous replications the plugin has to run itself
+*	until they fail or the plugin is interrupted. The user's starting
+*	target is restored first, as an interrupt ends the plugin without
+*	running its deferred calls.
+ */
+func runContinuousLocalReplications(httpClient *http.Client, localReplications map[string][]Replication, flags bcr_utils.Flags,
+	template ReplicationTemplate, rules map[string]RedactionRule, restore func()) {
+	numReplications := 0
+	for _, replications := range localReplications {
+		numReplications += len(replications)
+	}
+	if numReplications == 0 {
+		return
+	}
+	restore()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		fmt.Println("\nStopped the " + strconv.Itoa(numReplications) + " continuous replications run by the plugin")
+		os.Exit(0)
+	}()
+	fmt.Println("\nRunning " + strconv.Itoa(numReplications) + " continuous replications in the plugin. They only run " +
+		"while the plugin runs. Press " + terminal.ColorizeBold("Ctrl-C", 33) + " to stop.\n")
+	done := make(chan []ReplicationResult)
+	for db, replications := range localReplications {
+		go func(db string, replications []Replication) {
+			done <- runLocalReplications(db, httpClient, replications, flags, template, rules)
+		}(db, replications)
+	}
+	for i := 0; i < len(localReplications); i++ {
+		results := <-done
+		for j := 0; j < len(results); j++ {
+			if results[j].State == "error" {
+				bcr_utils.CheckErrorNonFatal(errors.New(results[j].Reason))
+			}
+		}
+	}
+	close(done)
+}
+
+/*
+*	Builds the options of a replication the plugin runs from the
+*	fields its replication document would have, so that doc_ids,
+*	selector, filter and the design document options limit it the
+*	same way. The other replication options only tune how Cloudant
+*	runs a replication and are left out. Any other template field is
+*	an error, since the plugin can't honour it.
+ */
+func getLocalReplicationOptions(db string, replication Replication, flags bcr_utils.Flags, template ReplicationTemplate) (bcr_replicator.Options, error) {
+	options := bcr_replicator.Options{Continuous: !flags.Once, CreateTarget: flags.Create}
+	rep := make(map[string]interface{})
+	rep["_id"] = getReplicationDocId(replication, db, flags.Placement)
+	applyReplicationTemplate(rep, template, db, replication)
+	err := validateReplicationFilters(rep)
+	if err == nil {
+		err = applyDesignDocOption(rep, flags.DesignDocs)
+	}
+	if err != nil {
+		return options, err
+	}
+	for field, value := range rep {
+		switch field {
+		case "_id":
+		case "doc_ids":
+			docIds, _ := value.([]interface{})
+			for i := 0; i < len(docIds); i++ {
+				if id, ok := docIds[i].(string); ok {
+					options.DocIds = append(options.DocIds, id)
+				}
+			}
+		case "selector":
+			options.Selector, _ = value.(map[string]interface{})
+		case "filter":
+			options.Filter, _ = value.(string)
+		case "query_params":
+			options.QueryParams, _ = value.(map[string]interface{})
+		case "since_seq":
+			options.SinceSeq = value
+		case "worker_batch_size":
+			if size, ok := value.(float64); ok {
+				options.BatchSize = int(size)
+			}
+		default:
+			if !bcr_utils.IsValid(field, REPLICATION_OPTIONS) {
+				return options, errors.New("Replication " + rep["_id"].(string) + " is run by the plugin, which can't apply the field '" +
+					terminal.ColorizeBold(field, 33) + "'. Nothing was replicated.")
+			}
+		}
+	}
+	if (rep["doc_ids"] != nil && len(options.DocIds) == 0) || (rep["selector"] != nil && options.Selector == nil) ||
+		(rep["filter"] != nil && options.Filter == "") {
+		return options, errors.New("Replication " + rep["_id"].(string) + " has an invalid doc_ids, selector or filter. Nothing was replicated.")
+	}
+	return options, nil
+}
+
+/*
+*	Local-only endpoints and Cloudant accounts are both reached with
+*	the credentials in their URL, since the session cookies are
+*	deleted before continuous replications start
+ */
+func getLocalEndpoint(account cam.CloudantAccount, db string) bcr_replicator.Endpoint {
+	return bcr_replicator.Endpoint{Url: account.Url + "/" + url.PathEscape(db)}
+}
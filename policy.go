@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+*	One line of a policy file: the databases matching Pattern may
+*	only exist in, and be replicated into, Regions
+ */
+type PolicyRule struct {
+	Pattern string
+	Regions []string
+}
+
+/*
+*	Reads a policy file. Each line holds one rule in the form
+*
+*		PATTERN = REGION,REGION,...
+*
+*	where PATTERN is a database name that may contain the wildcards
+*	of path.Match (e.g. "patients*"). The first rule matching a
+*	database applies, databases that match no rule may go anywhere.
+*	Blank lines and lines starting with '#' are ignored.
+ */
+func readPolicy(file string) ([]PolicyRule, error) {
+	var policy []PolicyRule
+	if file == "" {
+		return policy, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return policy, errors.New("Unable to open policy file '" + terminal.ColorizeBold(file, 36) + "'")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split_line := strings.SplitN(line, "=", 2)
+		pattern := strings.TrimSpace(split_line[0])
+		if len(split_line) != 2 || pattern == "" {
+			return policy, errors.New("Invalid rule on line " + strconv.Itoa(lineNum) + " of '" + file + "': " + line)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return policy, errors.New("Invalid pattern on line " + strconv.Itoa(lineNum) + " of '" + file + "': " + pattern)
+		}
+		rule := PolicyRule{Pattern: pattern}
+		split_regions := strings.Split(split_line[1], ",")
+		for i := 0; i < len(split_regions); i++ {
+			if region := strings.TrimSpace(split_regions[i]); region != "" {
+				rule.Regions = append(rule.Regions, region)
+			}
+		}
+		policy = append(policy, rule)
+	}
+	return policy, scanner.Err()
+}
+
+/*
+*	Returns whether the policy allows db in account's region
+ */
+func isAllowed(policy []PolicyRule, db string, account cam.CloudantAccount) bool {
+	for i := 0; i < len(policy); i++ {
+		if matched, _ := path.Match(policy[i].Pattern, db); matched {
+			for j := 0; j < len(policy[i].Regions); j++ {
+				if _, found := bcr_utils.FindAccount(policy[i].Regions[j], []cam.CloudantAccount{account}); found {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+/*
+*	Returns a line for every database creation, grant and replication
+*	of db that would break the policy. created are the accounts db is
+*	about to be created in.
+ */
+func getPolicyViolations(policy []PolicyRule, db string, created []cam.CloudantAccount, accounts []cam.CloudantAccount,
+	replications []Replication, placement string) []string {
+	var violations []string
+	if len(policy) == 0 {
+		return violations
+	}
+	for i := 0; i < len(created); i++ {
+		if !isAllowed(policy, db, created[i]) {
+			violations = append(violations, "creating '"+db+"' in "+created[i].Endpoint)
+		}
+	}
+	for i := 0; i < len(accounts); i++ {
+		for username := range getGrants(accounts[i], replications, placement) {
+			grantee, found := findAccountByUsername(username, accounts)
+			if found && !isAllowed(policy, db, grantee) {
+				violations = append(violations, "granting "+grantee.Endpoint+" access to '"+db+"' in "+accounts[i].Endpoint)
+			}
+		}
+	}
+	for i := 0; i < len(replications); i++ {
+		if !isAllowed(policy, db, replications[i].Target) {
+			violations = append(violations, "replicating '"+db+"' from "+replications[i].Source.Endpoint+" into "+
+				replications[i].Target.Endpoint)
+		}
+	}
+	return violations
+}
+
+/*
+*	Stops the plugin before anything is changed if violations is not
+*	empty
+ */
+func enforcePolicy(violations []string, file string) {
+	if len(violations) == 0 {
+		return
+	}
+	bcr_utils.CheckErrorFatal(errors.New("The policy in '" + terminal.ColorizeBold(file, 36) +
+		"' does not allow:\n\n" + strings.Join(violations, "\n") + "\n\nNothing was changed"))
+}
+
+/*
+*	Reports the replications that are already live and break the
+*	policy: replication documents whose source database lives in a
+*	region the policy doesn't allow, or whose target is such a region.
+*	Returns the number of violations.
+ */
+func checkLivePolicy(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, policy []PolicyRule, replicatorDb string) int {
+	fmt.Println("\nReading the existing replications\n")
+	docs := getAllReplicationDocuments(httpClient, cloudantAccounts, replicatorDb)
+	var violations []string
+	for i := 0; i < len(docs); i++ {
+		source, sourceFound := findAccountByUsername(docs[i].SourceAccount, cloudantAccounts)
+		target, targetFound := findAccountByUsername(docs[i].TargetAccount, cloudantAccounts)
+		line := terminal.ColorizeBold(docs[i].Id, 36) + " in " + docs[i].Owner.Endpoint + ": "
+		if sourceFound && !isAllowed(policy, docs[i].SourceDb, source) {
+			violations = append(violations, line+"'"+docs[i].SourceDb+"' is not allowed in source "+source.Endpoint)
+		}
+		if targetFound && !isAllowed(policy, docs[i].TargetDb, target) {
+			violations = append(violations, line+"'"+docs[i].TargetDb+"' is not allowed in target "+target.Endpoint)
+		}
+	}
+	fmt.Println(terminal.ColorizeBold("\nPOLICY CHECK", 35))
+	if len(violations) == 0 {
+		fmt.Println("\nNo live replication breaks the policy")
+		return 0
+	}
+	fmt.Println("\nLive replications breaking the policy:\n")
+	for i := 0; i < len(violations); i++ {
+		fmt.Println(violations[i])
+	}
+	return len(violations)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReadPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected []PolicyRule
+		fails    bool
+	}{
+		{"rules", "# EU data stays in the EU\npatients* = eu-gb, eu-de\n\n  orders=ng,eu-gb,\n* = ng\n",
+			[]PolicyRule{{"patients*", []string{"eu-gb", "eu-de"}}, {"orders", []string{"ng", "eu-gb"}}, {"*", []string{"ng"}}}, false},
+		{"database allowed nowhere", "secrets =\n", []PolicyRule{{Pattern: "secrets"}}, false},
+		{"comments only", "# nothing yet\n", nil, false},
+		{"missing =", "patients eu-gb\n", nil, true},
+		{"missing pattern", " = eu-gb\n", nil, true},
+		{"invalid pattern", "patients[ = eu-gb\n", nil, true},
+	}
+	for i := 0; i < len(tests); i++ {
+		file := writeTestFile(t, "policy", tests[i].contents)
+		policy, err := readPolicy(file)
+		os.Remove(file)
+		if tests[i].fails {
+			if err == nil {
+				t.Fatalf("%s: expected an error", tests[i].name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tests[i].name, err)
+		}
+		if !reflect.DeepEqual(policy, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].name, tests[i].expected, policy)
+		}
+	}
+	if policy, err := readPolicy(""); err != nil || policy != nil {
+		t.Fatalf("expected no policy without a file, got %v, %v", policy, err)
+	}
+	if _, err := readPolicy("missing-policy-file"); err == nil {
+		t.Fatalf("expected an error for a missing file")
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	ng, eu := topologyAccounts[0], topologyAccounts[1]
+	policy := []PolicyRule{
+		{"patients-uk", []string{"eu-gb"}},
+		{"patients*", []string{"https://api.eu-gb.bluemix.net", "eu-de"}},
+		{"secrets", nil},
+		{"logs-?", []string{"ng"}},
+	}
+	tests := []struct {
+		db       string
+		account  cam.CloudantAccount
+		expected bool
+	}{
+		{"patients-uk", eu, true},
+		{"patients-uk", ng, false},
+		{"patients-us", eu, true},
+		{"patients-us", ng, false},
+		{"secrets", ng, false},
+		{"secrets", eu, false},
+		{"logs-1", ng, true},
+		{"logs-1", eu, false},
+		{"logs-10", eu, true},
+		{"orders", ng, true},
+	}
+	for i := 0; i < len(tests); i++ {
+		if allowed := isAllowed(policy, tests[i].db, tests[i].account); allowed != tests[i].expected {
+			t.Fatalf("%s in %s: expected allowed to be %v", tests[i].db, tests[i].account.Endpoint, tests[i].expected)
+		}
+	}
+}
+
+func TestGetPolicyViolations(t *testing.T) {
+	ng, eu, au := topologyAccounts[0], topologyAccounts[1], topologyAccounts[2]
+	policy := []PolicyRule{{"patients*", []string{"eu-gb"}}, {"eu-only", []string{"eu-gb", "ng"}}}
+	mesh, _ := getReplications(bcr_utils.Flags{Topology: "mesh"}, []cam.CloudantAccount{ng, eu})
+	keyed := []Replication{{Source: eu, Target: ng, Key: ApiKey{Key: "key-1"}}}
+	tests := []struct {
+		name         string
+		policy       []PolicyRule
+		db           string
+		created      []cam.CloudantAccount
+		accounts     []cam.CloudantAccount
+		replications []Replication
+		placement    string
+		expected     []string
+	}{
+		{"no policy", nil, "patients", []cam.CloudantAccount{ng}, []cam.CloudantAccount{ng, eu}, mesh, "pull", nil},
+		{"database matching no rule", policy, "orders", []cam.CloudantAccount{ng, au}, []cam.CloudantAccount{ng, eu}, mesh, "pull", nil},
+		{"allowed everywhere it goes", policy, "eu-only", []cam.CloudantAccount{ng, eu}, []cam.CloudantAccount{ng, eu}, mesh, "push", nil},
+		{"creating", policy, "patients", []cam.CloudantAccount{ng, eu}, nil, nil, "pull",
+			[]string{"creating 'patients' in https://api.ng.bluemix.net"}},
+		{"mesh under pull", policy, "patients", nil, []cam.CloudantAccount{ng, eu}, mesh, "pull", []string{
+			"granting https://api.ng.bluemix.net access to 'patients' in https://api.eu-gb.bluemix.net",
+			"replicating 'patients' from https://api.eu-gb.bluemix.net into https://api.ng.bluemix.net"}},
+		{"mesh under push", policy, "patients", nil, []cam.CloudantAccount{ng, eu}, mesh, "push", []string{
+			"granting https://api.ng.bluemix.net access to 'patients' in https://api.eu-gb.bluemix.net",
+			"replicating 'patients' from https://api.eu-gb.bluemix.net into https://api.ng.bluemix.net"}},
+		{"api keys are not regions", policy, "patients", nil, []cam.CloudantAccount{ng, eu}, keyed, "pull", []string{
+			"replicating 'patients' from https://api.eu-gb.bluemix.net into https://api.ng.bluemix.net"}},
+	}
+	for i := 0; i < len(tests); i++ {
+		violations := getPolicyViolations(tests[i].policy, tests[i].db, tests[i].created, tests[i].accounts,
+			tests[i].replications, tests[i].placement)
+		if !reflect.DeepEqual(violations, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].name, tests[i].expected, violations)
+		}
+	}
+}
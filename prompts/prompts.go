@@ -34,9 +34,9 @@ func GetPassword() string {
 *	Lists all databases for a specified CloudantAccount and
 *	prompts the user to select one
  */
-func GetDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) ([]string, error) {
+func GetDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, replicatorDb string) ([]string, error) {
 	reader := bufio.NewReader(os.Stdin)
-	all_dbs := bcr_utils.GetAllDatabases(httpClient, cloudantAccounts)
+	all_dbs := bcr_utils.GetAllDatabases(httpClient, cloudantAccounts, replicatorDb)
 	if len(all_dbs) == 0 {
 		return all_dbs, errors.New("No databases found for CloudantNoSQLDB services in any region")
 	}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+/*
+*	How documents are changed before they are written to a restricted
+*	region. Drop lists the JSON paths (e.g. "customer.email") that are
+*	removed and StripAttachments removes every attachment.
+ */
+type RedactionRule struct {
+	Drop             []string `json:"drop"`
+	StripAttachments bool     `json:"strip_attachments"`
+}
+
+/*
+*	Reads the file passed with --redaction-rules, which holds the
+*	rule for each restricted region:
+*
+*		{
+*			"ng": {"drop": ["customer.email", "customer.phone"], "strip_attachments": true},
+*			"au-syd": {"drop": ["customer.email"]}
+*		}
+*
+*	The rules are returned by account username. A region that is
+*	neither a known endpoint nor a local-only endpoint is an error, so
+*	that a typo can't leave a region unprotected.
+ */
+func readRedactionRules(file string, cloudantAccounts []cam.CloudantAccount) (map[string]RedactionRule, error) {
+	rules := make(map[string]RedactionRule)
+	if file == "" {
+		return rules, nil
+	}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return rules, errors.New("Unable to read redaction rules '" + terminal.ColorizeBold(file, 36) + "'")
+	}
+	var regionRules map[string]RedactionRule
+	err = json.Unmarshal(contents, &regionRules)
+	if err != nil {
+		return rules, errors.New("Redaction rules '" + terminal.ColorizeBold(file, 36) + "' are not valid JSON: " + err.Error())
+	}
+	for region, rule := range regionRules {
+		for i := 0; i < len(rule.Drop); i++ {
+			if strings.HasPrefix(rule.Drop[i], "_") || rule.Drop[i] == "" {
+				return rules, errors.New("The redaction rules for '" + terminal.ColorizeBold(region, 36) +
+					"' may not drop '" + rule.Drop[i] + "'")
+			}
+		}
+		account, found := bcr_utils.FindAccount(region, cloudantAccounts)
+		if found {
+			rules[account.Username] = rule
+			continue
+		}
+		known := false
+		for i := 0; i < len(ENDPOINTS); i++ {
+			if region == ENDPOINTS[i] || region == bcr_utils.GetRegion(ENDPOINTS[i]) {
+				known = true
+			}
+		}
+		if !known {
+			return rules, errors.New("Unknown region '" + terminal.ColorizeBold(region, 36) + "' in redaction rules '" +
+				terminal.ColorizeBold(file, 36) + "'")
+		}
+	}
+	return rules, nil
+}
+
+/*
+*	Returns whether documents written to the target of replication
+*	have to be redacted
+ */
+func isRedacted(replication Replication, rules map[string]RedactionRule) bool {
+	_, found := rules[replication.Target.Username]
+	return found
+}
+
+/*
+*	Returns the transformation applying rule to a document
+ */
+func redactDocument(rule RedactionRule) func(doc map[string]interface{}) map[string]interface{} {
+	return func(doc map[string]interface{}) map[string]interface{} {
+		for i := 0; i < len(rule.Drop); i++ {
+			dropPath(doc, strings.Split(rule.Drop[i], "."))
+		}
+		if rule.StripAttachments {
+			delete(doc, "_attachments")
+		}
+		return doc
+	}
+}
+
+/*
+*	Removes the field at path from obj. Arrays on the way are walked
+*	element by element.
+ */
+func dropPath(obj interface{}, path []string) {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else if child, found := v[path[0]]; found {
+			dropPath(child, path[1:])
+		}
+	case []interface{}:
+		for i := 0; i < len(v); i++ {
+			dropPath(v[i], path)
+		}
+	}
+}
+
+/*
+*	Returns the replications whose documents are redacted
+ */
+func getRedactedReplications(replications []Replication, rules map[string]RedactionRule) []Replication {
+	var redacted []Replication
+	for i := 0; i < len(replications); i++ {
+		if isRedacted(replications[i], rules) {
+			redacted = append(redacted, replications[i])
+		}
+	}
+	return redacted
+}
+
+/*
+*	Prints the replications whose documents are redacted, by database
+ */
+func printRedactedReplications(dbs []string, redacted map[string][]Replication, rules map[string]RedactionRule, deleted []ReplicationDocument) {
+	if len(deleted) > 0 {
+		fmt.Println("\nDeleted replication documents writing unredacted documents:\n")
+		for i := 0; i < len(deleted); i++ {
+			fmt.Println(terminal.ColorizeBold(deleted[i].Id, 36) + " in " + deleted[i].Owner.Endpoint + " (" +
+				deleted[i].SourceDb + " -> " + deleted[i].TargetDb + ")")
+		}
+		fmt.Println("\nThey were replaced by redacted replications run by the plugin, which are only kept in sync while it runs " +
+			"with '" + terminal.ColorizeBold("--foreground", 33) + "'")
+	}
+	if len(redacted) == 0 {
+		return
+	}
+	fmt.Println("\nRedacted replications:\n")
+	for i := 0; i < len(dbs); i++ {
+		for j := 0; j < len(redacted[dbs[i]]); j++ {
+			r := redacted[dbs[i]][j]
+			rule := rules[r.Target.Username]
+			line := terminal.ColorizeBold(dbs[i], 36) + ": " + r.Source.Endpoint + " -> " + r.Target.Endpoint
+			var changes []string
+			if len(rule.Drop) > 0 {
+				changes = append(changes, "dropping "+strings.Join(rule.Drop, ", "))
+			}
+			if rule.StripAttachments {
+				changes = append(changes, "stripping attachments")
+			}
+			if len(changes) > 0 {
+				line += " " + strings.Join(changes, " and ")
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+/*
+*	Deletes the replication documents of dbs that let Cloudant write
+*	into a region with redaction rules, left behind by runs without
+*	them. The replications of other databases are left alone, as they
+*	aren't replaced in this run. Returns the deleted documents.
+ */
+func deleteUnredactedReplications(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, rules map[string]RedactionRule, dbs []string, replicatorDb string) []ReplicationDocument {
+	var docs []ReplicationDocument
+	if len(rules) == 0 {
+		return docs
+	}
+	all_docs := getAllReplicationDocuments(httpClient, getCloudAccounts(cloudantAccounts), replicatorDb)
+	for i := 0; i < len(all_docs); i++ {
+		if _, found := rules[all_docs[i].TargetAccount]; found && bcr_utils.IsValid(all_docs[i].TargetDb, dbs) {
+			docs = append(docs, all_docs[i])
+		}
+	}
+	if len(docs) > 0 {
+		deleteReplicationDocuments(httpClient, docs, replicatorDb)
+	}
+	return docs
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedactDocument(t *testing.T) {
+	body := `{"_id":"order-1","_rev":"1-a","customer":{"email":"a@example.com","name":"A","phone":"1"},` +
+		`"items":[{"sku":"x","price":1,"notes":{"gift":"for B","internal":"ok"}},{"sku":"y"},"loose",[{"price":2}]],` +
+		`"_attachments":{"invoice.pdf":{"stub":true}}}`
+	tests := []struct {
+		name     string
+		rule     RedactionRule
+		expected string
+	}{
+		{"no rule", RedactionRule{}, body},
+		{"top level field", RedactionRule{Drop: []string{"customer"}},
+			`{"_attachments":{"invoice.pdf":{"stub":true}},"_id":"order-1","_rev":"1-a",` +
+				`"items":[{"notes":{"gift":"for B","internal":"ok"},"price":1,"sku":"x"},{"sku":"y"},"loose",[{"price":2}]]}`},
+		{"nested fields", RedactionRule{Drop: []string{"customer.email", "customer.phone"}},
+			`{"_attachments":{"invoice.pdf":{"stub":true}},"_id":"order-1","_rev":"1-a","customer":{"name":"A"},` +
+				`"items":[{"notes":{"gift":"for B","internal":"ok"},"price":1,"sku":"x"},{"sku":"y"},"loose",[{"price":2}]]}`},
+		{"field of array elements", RedactionRule{Drop: []string{"items.price"}},
+			`{"_attachments":{"invoice.pdf":{"stub":true}},"_id":"order-1","_rev":"1-a","customer":{"email":"a@example.com","name":"A","phone":"1"},` +
+				`"items":[{"notes":{"gift":"for B","internal":"ok"},"sku":"x"},{"sku":"y"},"loose",[{}]]}`},
+		{"nested field of array elements", RedactionRule{Drop: []string{"items.notes.gift"}},
+			`{"_attachments":{"invoice.pdf":{"stub":true}},"_id":"order-1","_rev":"1-a","customer":{"email":"a@example.com","name":"A","phone":"1"},` +
+				`"items":[{"notes":{"internal":"ok"},"price":1,"sku":"x"},{"sku":"y"},"loose",[{"price":2}]]}`},
+		{"missing paths", RedactionRule{Drop: []string{"shipping.address", "customer.email.domain", "items.sku.code"}}, body},
+		{"attachments", RedactionRule{Drop: []string{"customer.email"}, StripAttachments: true},
+			`{"_id":"order-1","_rev":"1-a","customer":{"name":"A","phone":"1"},` +
+				`"items":[{"notes":{"gift":"for B","internal":"ok"},"price":1,"sku":"x"},{"sku":"y"},"loose",[{"price":2}]]}`},
+	}
+	for i := 0; i < len(tests); i++ {
+		var doc, expected map[string]interface{}
+		json.Unmarshal([]byte(body), &doc)
+		json.Unmarshal([]byte(tests[i].expected), &expected)
+		redacted, _ := json.Marshal(redactDocument(tests[i].rule)(doc))
+		expectedBody, _ := json.Marshal(expected)
+		if string(redacted) != string(expectedBody) {
+			t.Fatalf("%s: expected %s, got %s", tests[i].name, expectedBody, redacted)
+		}
+	}
+}
+
+func TestReadRedactionRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected map[string]int
+		fails    string
+	}{
+		{"by region and endpoint", `{"ng": {"drop": ["customer.email"]}, "https://api.eu-gb.bluemix.net": {"strip_attachments": true}}`,
+			map[string]int{"acct-ng": 1, "acct-eu": 0}, ""},
+		{"known region without a service", `{"au-syd": {"drop": ["customer"]}}`, map[string]int{}, ""},
+		{"unknown region", `{"eu-gbb": {"drop": ["customer"]}}`, nil, "Unknown region"},
+		{"reserved field", `{"ng": {"drop": ["_id"]}}`, nil, "may not drop"},
+		{"empty path", `{"ng": {"drop": [""]}}`, nil, "may not drop"},
+		{"invalid JSON", `{"ng": `, nil, "not valid JSON"},
+	}
+	for i := 0; i < len(tests); i++ {
+		file := writeTestFile(t, "redaction", tests[i].contents)
+		rules, err := readRedactionRules(file, topologyAccounts[:2])
+		os.Remove(file)
+		if tests[i].fails != "" {
+			if err == nil || !strings.Contains(err.Error(), tests[i].fails) {
+				t.Fatalf("%s: expected an error containing %q, got %v", tests[i].name, tests[i].fails, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tests[i].name, err)
+		}
+		if len(rules) != len(tests[i].expected) {
+			t.Fatalf("%s: expected rules for %v, got %v", tests[i].name, tests[i].expected, rules)
+		}
+		for username, numDrop := range tests[i].expected {
+			if rule, found := rules[username]; !found || len(rule.Drop) != numDrop {
+				t.Fatalf("%s: expected a rule dropping %d paths for %s, got %v", tests[i].name, numDrop, username, rules)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+*	Takes a region out of the replication mesh. Every replication
+*	document in any region that replicates between the region's
+*	account and another account is deleted. The roles the plugin
+*	grants that the account, and the API keys those documents used,
+*	hold are removed from the permissions of every database in the
+*	remaining regions. A region whose Cloudant service can't be found
+*	any more is passed by the username of its account.
+ */
+func removeRegion(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if len(flags.Args) != 1 {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the region to remove. For help look to '" +
+			terminal.ColorizeBold("cf help cloudant-remove-region", 33) + "'"))
+	}
+	region := flags.Args[0]
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	removedAccount, found := bcr_utils.FindAccount(region, cloudantAccounts)
+	if !found {
+		removedAccount = getUnreachableAccount(region, appname)
+	}
+	var remainingAccounts []cam.CloudantAccount
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if cloudantAccounts[i].Username != removedAccount.Username {
+			remainingAccounts = append(remainingAccounts, cloudantAccounts[i])
+		}
+	}
+	fmt.Println("\nReading the existing replications\n")
+	all_docs := getAllReplicationDocuments(httpClient, cloudantAccounts, flags.ReplicatorDb)
+	var docs []ReplicationDocument
+	usernames := []string{removedAccount.Username}
+	for i := 0; i < len(all_docs); i++ {
+		if all_docs[i].SourceAccount == all_docs[i].TargetAccount ||
+			(all_docs[i].SourceAccount != removedAccount.Username && all_docs[i].TargetAccount != removedAccount.Username) {
+			continue
+		}
+		docs = append(docs, all_docs[i])
+		credentials := []string{getReplicationCredential(all_docs[i].Doc["source"]), getReplicationCredential(all_docs[i].Doc["target"])}
+		for j := 0; j < len(credentials); j++ {
+			if _, isAccount := findAccountByUsername(credentials[j], remainingAccounts); credentials[j] != "" && !isAccount &&
+				!bcr_utils.IsValid(credentials[j], usernames) {
+				usernames = append(usernames, credentials[j])
+			}
+		}
+	}
+	deleteReplicationDocuments(httpClient, docs, flags.ReplicatorDb)
+	fmt.Println("\nReading database permissions\n")
+	access, _ := getDatabaseAccess(httpClient, remainingAccounts, nil, flags.ReplicatorDb)
+	var dbs []string
+	for db, dbAccess := range access {
+		for _, grantees := range dbAccess {
+			for j := 0; j < len(usernames); j++ {
+				if _, found := grantees[usernames[j]]; found && !bcr_utils.IsValid(db, dbs) {
+					dbs = append(dbs, db)
+				}
+			}
+		}
+	}
+	sort.Strings(dbs)
+	removed := unshareDatabases(dbs, httpClient, remainingAccounts, usernames)
+	deleteCookies(httpClient, cloudantAccounts)
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\n'" + terminal.ColorizeBold(removedAccount.Endpoint, 36) + "' was removed from the replication of '" +
+		terminal.ColorizeBold(appname, 36) + "'")
+	fmt.Println("\nDeleted replication documents:\n")
+	for i := 0; i < len(docs); i++ {
+		fmt.Println(terminal.ColorizeBold(docs[i].Id, 36) + " in " + docs[i].Owner.Endpoint)
+	}
+	fmt.Println("\nRemoved permissions:\n")
+	for i := 0; i < len(removed); i++ {
+		fmt.Println(removed[i])
+	}
+	if len(docs) == 0 && len(removed) == 0 {
+		fmt.Println("\nNo replications or permissions referring to '" + terminal.ColorizeBold(removedAccount.Endpoint, 36) + "' were found")
+	}
+	printSecuritySnapshot()
+}
+
+/*
+*	Returns the account of a region that is no longer found, passed by
+*	its username. A region name can't be resolved to an account then,
+*	so it is refused.
+ */
+func getUnreachableAccount(arg string, appname string) cam.CloudantAccount {
+	for i := 0; i < len(ENDPOINTS); i++ {
+		if arg == ENDPOINTS[i] || arg == bcr_utils.GetRegion(ENDPOINTS[i]) {
+			bcr_utils.CheckErrorFatal(errors.New("No Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
+				"' in region '" + terminal.ColorizeBold(arg, 36) + "'. If the region is gone, pass the username of its Cloudant " +
+				"account instead, as found in the replication documents of the other regions"))
+		}
+	}
+	fmt.Println(terminal.ColorizeBold("WARNING", 33) + ": no Cloudant service of '" + terminal.ColorizeBold(appname, 36) +
+		"' was found for '" + terminal.ColorizeBold(arg, 36) + "', removing it as the username of an unreachable account\n")
+	return cam.CloudantAccount{Username: arg, Endpoint: arg}
+}
+
+/*
+*	Deletes each of docs from its owner's replicator database
+ */
+func deleteReplicationDocuments(httpClient *http.Client, docs []ReplicationDocument, replicatorDb string) {
+	fmt.Println("\nDeleting replication documents\n")
+	responses := make(chan bcr_utils.HttpResponse)
+	for i := 0; i < len(docs); i++ {
+		go func(httpClient *http.Client, doc ReplicationDocument) {
+			responses <- deleteReplicationDocument(httpClient, doc, replicatorDb)
+		}(httpClient, docs[i])
+	}
+	bcr_utils.CheckHttpResponses(responses, len(docs))
+	close(responses)
+}
+
+/*
+*	Removes usernames from the permissions of each of dbs in every
+*	account. Returns a line describing every entry that was removed.
+ */
+func unshareDatabases(dbs []string, httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, usernames []string) []string {
+	fmt.Println("\nRemoving database permissions\n")
+	var removed []string
+	responses := make(chan bcr_utils.HttpResponse)
+	removed_ch := make(chan []string)
+	for i := 0; i < len(dbs); i++ {
+		for j := 0; j < len(cloudantAccounts); j++ {
+			go func(db string, httpClient *http.Client, account cam.CloudantAccount) {
+				var lines []string
+				sec, r := getSecurity(db, httpClient, account)
+				split_status := strings.Split(r.Status, " ")[0]
+				status, _ := strconv.Atoi(split_status)
+				if status != 200 || r.Err != nil {
+					responses <- bcr_utils.HttpResponse{}
+					removed_ch <- lines
+					return
+				}
+				resp, removedRoles := revokePermissions(sec, db, httpClient, account, usernames)
+				if resp.Err == nil {
+					for username, roles := range removedRoles {
+						lines = append(lines, terminal.ColorizeBold(username, 36)+" ("+strings.Join(roles, ", ")+") from '"+
+							terminal.ColorizeBold(db, 36)+"' in "+account.Endpoint)
+					}
+				}
+				responses <- resp
+				removed_ch <- lines
+			}(dbs[i], httpClient, cloudantAccounts[j])
+		}
+	}
+	bcr_utils.CheckHttpResponses(responses, len(dbs)*len(cloudantAccounts))
+	close(responses)
+	for i := 0; i < len(dbs)*len(cloudantAccounts); i++ {
+		removed = append(removed, <-removed_ch...)
+	}
+	close(removed_ch)
+	sort.Strings(removed)
+	return removed
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+*	A replication document read back from an account's replicator
+*	database. The source and target accounts are identified by the
+*	username in the host of their URL.
+ */
+type ReplicationDocument struct {
+	Id            string
+	Rev           string
+	Owner         cam.CloudantAccount
+	SourceAccount string
+	SourceDb      string
+	TargetAccount string
+	TargetDb      string
+	Continuous    bool
+	State         string
+	Doc           map[string]interface{}
+}
+
+/*
+*	Reads every replication document in account's replicator database
+ */
+func getReplicationDocuments(httpClient *http.Client, account cam.CloudantAccount, replicatorDb string) ([]ReplicationDocument, error) {
+	var docs []ReplicationDocument
+	url := "https://" + account.Username + ".cloudant.com/" + replicatorDb + "/_all_docs?include_docs=true"
+	headers := map[string]string{"Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", url, "", headers)
+	if err != nil {
+		return docs, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 {
+		return docs, errors.New("Unable to read '" + terminal.ColorizeBold(replicatorDb, 36) + "' in '" +
+			terminal.ColorizeBold(account.Endpoint, 36) + "'")
+	}
+	var all_docs struct {
+		Rows []struct {
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	json.Unmarshal(respBody, &all_docs)
+	for i := 0; i < len(all_docs.Rows); i++ {
+		doc := all_docs.Rows[i].Doc
+		id, _ := doc["_id"].(string)
+		if doc == nil || strings.HasPrefix(id, "_design/") {
+			continue
+		}
+		r := ReplicationDocument{Id: id, Owner: account, Doc: doc}
+		r.Rev, _ = doc["_rev"].(string)
+		r.SourceAccount, r.SourceDb = parseReplicationEndpoint(doc["source"])
+		r.TargetAccount, r.TargetDb = parseReplicationEndpoint(doc["target"])
+		r.Continuous, _ = doc["continuous"].(bool)
+		r.State, _ = doc["_replication_state"].(string)
+		docs = append(docs, r)
+	}
+	return docs, nil
+}
+
+/*
+*	Reads the replication documents of every account. Accounts whose
+*	replicator database can't be read are reported and skipped.
+ */
+func getAllReplicationDocuments(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, replicatorDb string) []ReplicationDocument {
+	var all_docs []ReplicationDocument
+	doc_ch := make(chan []ReplicationDocument)
+	for i := 0; i < len(cloudantAccounts); i++ {
+		go func(httpClient *http.Client, account cam.CloudantAccount) {
+			docs, err := getReplicationDocuments(httpClient, account, replicatorDb)
+			bcr_utils.CheckErrorNonFatal(err)
+			doc_ch <- docs
+		}(httpClient, cloudantAccounts[i])
+	}
+	for i := 0; i < len(cloudantAccounts); i++ {
+		all_docs = append(all_docs, <-doc_ch...)
+	}
+	close(doc_ch)
+	return all_docs
+}
+
+/*
+*	Returns the account username and database of the source or
+*	target of a replication document, which is either a URL or an
+*	object holding one.
+ */
+func parseReplicationEndpoint(endpoint interface{}) (string, string) {
+	raw, ok := endpoint.(string)
+	if obj, isObj := endpoint.(map[string]interface{}); isObj {
+		raw, ok = obj["url"].(string)
+	}
+	if !ok {
+		return "", ""
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "", ""
+	}
+	username := strings.Split(parsed.Host, ".")[0]
+	db, err := url.PathUnescape(strings.TrimPrefix(parsed.Path, "/"))
+	if err != nil {
+		db = strings.TrimPrefix(parsed.Path, "/")
+	}
+	return username, db
+}
+
+/*
+*	Returns the username of the credentials in the URL of the source
+*	or target of a replication document, if it holds any
+ */
+func getReplicationCredential(endpoint interface{}) string {
+	raw, ok := endpoint.(string)
+	if obj, isObj := endpoint.(map[string]interface{}); isObj {
+		raw, ok = obj["url"].(string)
+	}
+	if !ok {
+		return ""
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.User == nil {
+		return ""
+	}
+	return parsed.User.Username()
+}
+
+/*
+*	Returns the account with the given username
+ */
+func findAccountByUsername(username string, cloudantAccounts []cam.CloudantAccount) (cam.CloudantAccount, bool) {
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if cloudantAccounts[i].Username == username {
+			return cloudantAccounts[i], true
+		}
+	}
+	return cam.CloudantAccount{}, false
+}
+
+/*
+*	Deletes a replication document from its owner's replicator
+*	database, which also cancels the replication
+ */
+func deleteReplicationDocument(httpClient *http.Client, doc ReplicationDocument, replicatorDb string) bcr_utils.HttpResponse {
+	docUrl := "https://" + doc.Owner.Username + ".cloudant.com/" + replicatorDb + "/" + url.PathEscape(doc.Id) + "?rev=" + doc.Rev
+	headers := map[string]string{"Cookie": doc.Owner.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "DELETE", docUrl, "", headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "DELETE", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 && status != 202 {
+		err = errors.New("Trouble deleting " + doc.Id + " for '" + doc.Owner.Endpoint + "'")
+	}
+	return bcr_utils.HttpResponse{RequestType: "DELETE", Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Deletes the replication documents with the given ids from
+*	account's replicator database, e.g. one-shot documents once their
+*	replication completed
+ */
+func deleteReplicationDocumentsById(httpClient *http.Client, account cam.CloudantAccount, replicatorDb string, docIds []string) error {
+	docs, err := getReplicationDocuments(httpClient, account, replicatorDb)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(docs); i++ {
+		if bcr_utils.IsValid(docs[i].Id, docIds) {
+			if r := deleteReplicationDocument(httpClient, docs[i], replicatorDb); r.Err != nil {
+				return r.Err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+*	Called when a replication document with the same _id already
+*	exists. The existing document is kept when it replicates with the
+*	same fields as rep, otherwise it is deleted and rep is created in
+*	its place. The replication keeps its checkpoints, which are tied to
+*	the replication and not the document.
+ */
+func updateReplicationDocument(httpClient *http.Client, account cam.CloudantAccount, replicatorUrl string, rep map[string]interface{}) (bcr_utils.HttpResponse, string) {
+	id := rep["_id"].(string)
+	docUrl := replicatorUrl + "/" + url.PathEscape(id)
+	headers := map[string]string{"Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", docUrl, "", headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Err: err}, ""
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	var existing map[string]interface{}
+	if status != 200 || json.Unmarshal(respBody, &existing) != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody),
+			Err: errors.New("Trouble reading the existing " + id + " for '" + account.Endpoint + "'")}, ""
+	}
+	if !replicationDocumentDiffers(existing, rep) {
+		return bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody)}, "unchanged"
+	}
+	rev, _ := existing["_rev"].(string)
+	deleteResp, err := bcr_utils.MakeRequest(httpClient, "DELETE", docUrl+"?rev="+rev, "", headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "DELETE", Err: err}, ""
+	}
+	defer deleteResp.Body.Close()
+	deleteBody, _ := ioutil.ReadAll(deleteResp.Body)
+	split_status = strings.Split(deleteResp.Status, " ")[0]
+	status, _ = strconv.Atoi(split_status)
+	if status != 200 && status != 202 {
+		return bcr_utils.HttpResponse{RequestType: "DELETE", Status: deleteResp.Status, Body: string(deleteBody),
+			Err: errors.New("Trouble replacing " + id + " for '" + account.Endpoint + "'")}, ""
+	}
+	r, outcome := postReplicationDocument(httpClient, account, replicatorUrl, rep)
+	if outcome == "created" {
+		outcome = "updated"
+	}
+	return r, outcome
+}
+
+/*
+*	Returns whether an existing replication document replicates
+*	differently from rep. Fields set by the replicator and the owner
+*	field are not compared.
+ */
+func replicationDocumentDiffers(existing map[string]interface{}, rep map[string]interface{}) bool {
+	var wanted map[string]interface{}
+	bd, _ := json.Marshal(rep)
+	json.Unmarshal(bd, &wanted)
+	for field, value := range existing {
+		if strings.HasPrefix(field, "_") || field == "owner" {
+			continue
+		}
+		if !reflect.DeepEqual(value, wanted[field]) {
+			return true
+		}
+	}
+	for field := range wanted {
+		if _, found := existing[field]; !found && !strings.HasPrefix(field, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*	Deletes the documents left over from an earlier run with a
+*	different number of shards: the unsharded docId and its shards
+*	that aren't among docIds. Returns whether any was deleted.
+ */
+func deleteStaleShards(httpClient *http.Client, account cam.CloudantAccount, replicatorDb string, docId string, docIds []string) (bool, error) {
+	docs, err := getReplicationDocuments(httpClient, account, replicatorDb)
+	if err != nil {
+		return false, err
+	}
+	deleted := false
+	for i := 0; i < len(docs); i++ {
+		if bcr_utils.IsValid(docs[i].Id, docIds) || (docs[i].Id != docId && !strings.HasPrefix(docs[i].Id, docId+"-shard-")) {
+			continue
+		}
+		r := deleteReplicationDocument(httpClient, docs[i], replicatorDb)
+		if r.Err != nil {
+			return deleted, r.Err
+		}
+		deleted = true
+	}
+	return deleted, nil
+}
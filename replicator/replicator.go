@@ -0,0 +1,511 @@
+package bcr_replicator
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+*	A database taking part in a replication. Url is the full URL of
+*	the database and may hold credentials, Headers are added to every
+*	request (e.g. a session cookie).
+ */
+type Endpoint struct {
+	Url     string
+	Headers map[string]string
+}
+
+/*
+*	Options of a client-side replication. Transform, if set, is
+*	applied to every document before it is written to the target.
+*	DocIds, Selector or Filter with its QueryParams limit the
+*	replication to some documents, as in a replication document.
+*	SinceSeq is where a replication without a checkpoint starts.
+*	TargetCheckpointOnly keeps the checkpoint in the target only, so
+*	nothing is written to the source.
+ */
+type Options struct {
+	Continuous           bool
+	CreateTarget         bool
+	BatchSize            int
+	Transform            func(doc map[string]interface{}) map[string]interface{}
+	DocIds               []string
+	Selector             map[string]interface{}
+	Filter               string
+	QueryParams          map[string]interface{}
+	SinceSeq             interface{}
+	TargetCheckpointOnly bool
+}
+
+type Result struct {
+	DocsRead         int
+	DocsWritten      int
+	DocWriteFailures int
+	LastSeq          interface{}
+}
+
+/*
+*	The revisions _revs_diff reports missing, keyed by document id
+ */
+type revsDiff map[string]struct {
+	Missing []string `json:"missing"`
+}
+
+type change struct {
+	Seq     interface{} `json:"seq"`
+	Id      string      `json:"id"`
+	Changes []struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+}
+
+var DEFAULT_BATCH_SIZE = 500
+
+/*
+*	How long a continuous replication waits for new changes on the
+*	source before asking again
+ */
+var LONGPOLL_TIMEOUT = 60 * time.Second
+
+/*
+*	How often a continuous replication retries after an error in a
+*	row before giving up, and how long it waits before the first
+*	retry. The wait doubles with every retry up to MAX_RETRY_DELAY.
+ */
+var MAX_RETRIES = 10
+var RETRY_DELAY = 1 * time.Second
+var MAX_RETRY_DELAY = 5 * time.Minute
+
+/*
+*	Replicates source into target using the CouchDB replication
+*	protocol, with the plugin itself moving the documents:
+*
+*	1. read the checkpoint from _local/<replication id> on both sides
+*	2. read a batch of _changes from the source since the checkpoint
+*	3. ask the target which revisions it is missing with _revs_diff
+*	4. fetch them with _bulk_get, or open_revs if it isn't supported
+*	5. write them to the target with _bulk_docs and new_edits=false
+*	6. record the checkpoint on both sides and continue with 2
+*
+*	A one-shot replication returns once the source has no more
+*	changes, a continuous one keeps waiting for new changes and
+*	retries after errors. Revisions that can't be read from the
+*	source are counted as failures, and no checkpoint is recorded past
+*	them, so the next run tries them again.
+ */
+func Replicate(httpClient *http.Client, source Endpoint, target Endpoint, options Options) (Result, error) {
+	result := Result{}
+	if options.BatchSize < 1 {
+		options.BatchSize = DEFAULT_BATCH_SIZE
+	}
+	status, _, err := request(httpClient, "GET", source, "", nil)
+	if err != nil {
+		return result, err
+	}
+	if status != 200 {
+		return result, errors.New("Source database " + redact(source.Url) + " does not exist")
+	}
+	status, _, err = request(httpClient, "GET", target, "", nil)
+	if err != nil {
+		return result, err
+	}
+	if status == 404 && options.CreateTarget {
+		status, _, err = request(httpClient, "PUT", target, "", nil)
+		if err != nil {
+			return result, err
+		}
+	}
+	if status != 200 && status != 201 && status != 202 {
+		return result, errors.New("Target database " + redact(target.Url) + " does not exist")
+	}
+	if countFilters(options) > 1 {
+		return result, errors.New("Only one of doc_ids, selector and filter can be used")
+	}
+	repId := getReplicationId(source, target, options)
+	sessionId := newSessionId()
+	since := getCheckpoint(httpClient, source, target, repId, options.TargetCheckpointOnly)
+	if since == nil {
+		since = options.SinceSeq
+	}
+	retries := 0
+	held := false
+	for {
+		changes, lastSeq, err := getChanges(httpClient, source, since, options)
+		if err == nil && len(changes) > 0 {
+			written, failures, unread, read, batchErr := replicateBatch(httpClient, source, target, changes, options)
+			result.DocsRead += read
+			result.DocsWritten += written
+			result.DocWriteFailures += failures
+			err = batchErr
+			if err == nil && unread > 0 {
+				if options.Continuous {
+					err = errors.New(strconv.Itoa(unread) + " revisions could not be read from " + redact(source.Url))
+				} else {
+					result.DocWriteFailures += unread
+					held = true
+				}
+			}
+		}
+		if err != nil {
+			if options.Continuous && retries < MAX_RETRIES {
+				time.Sleep(getRetryDelay(retries))
+				retries += 1
+				continue
+			}
+			return result, err
+		}
+		retries = 0
+		if len(changes) > 0 {
+			since = lastSeq
+			result.LastSeq = since
+			if !held {
+				saveCheckpoint(httpClient, source, target, repId, sessionId, since, options.TargetCheckpointOnly)
+			}
+		} else if !options.Continuous {
+			result.LastSeq = since
+			return result, nil
+		} else if lastSeq != nil {
+			since = lastSeq
+		}
+	}
+}
+
+/*
+*	Reads a batch of changes since seq. Continuous replications wait
+*	for changes with a longpoll feed.
+ */
+func getChanges(httpClient *http.Client, source Endpoint, since interface{}, options Options) ([]change, interface{}, error) {
+	query := "?style=all_docs&limit=" + strconv.Itoa(options.BatchSize)
+	if since != nil {
+		query += "&since=" + url.QueryEscape(seqString(since))
+	}
+	if options.Continuous {
+		query += "&feed=longpoll&timeout=" + strconv.Itoa(int(LONGPOLL_TIMEOUT/time.Millisecond))
+	}
+	var status int
+	var body []byte
+	var err error
+	if len(options.DocIds) > 0 {
+		status, body, err = request(httpClient, "POST", source, "/_changes"+query+"&filter=_doc_ids",
+			map[string]interface{}{"doc_ids": options.DocIds})
+	} else if options.Selector != nil {
+		status, body, err = request(httpClient, "POST", source, "/_changes"+query+"&filter=_selector",
+			map[string]interface{}{"selector": options.Selector})
+	} else if options.Filter != "" {
+		query += "&filter=" + url.QueryEscape(options.Filter)
+		for param, value := range options.QueryParams {
+			query += "&" + url.QueryEscape(param) + "=" + url.QueryEscape(seqString(value))
+		}
+		status, body, err = request(httpClient, "GET", source, "/_changes"+query, nil)
+	} else {
+		status, body, err = request(httpClient, "GET", source, "/_changes"+query, nil)
+	}
+	if err != nil {
+		return nil, since, err
+	}
+	if status != 200 {
+		return nil, since, errors.New("Unable to read the changes of " + redact(source.Url) + ": " + string(body))
+	}
+	var feed struct {
+		Results []change    `json:"results"`
+		LastSeq interface{} `json:"last_seq"`
+	}
+	err = json.Unmarshal(body, &feed)
+	if err != nil {
+		return nil, since, err
+	}
+	return feed.Results, feed.LastSeq, nil
+}
+
+/*
+*	Returns how long to wait before the next retry
+ */
+func getRetryDelay(retries int) time.Duration {
+	delay := RETRY_DELAY
+	for i := 0; i < retries && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		delay = MAX_RETRY_DELAY
+	}
+	return delay
+}
+
+/*
+*	Copies the revisions in changes that the target is missing.
+*	Returns the number of documents written and failed, the number of
+*	missing revisions that could not be read from the source and the
+*	number of documents read.
+ */
+func replicateBatch(httpClient *http.Client, source Endpoint, target Endpoint, changes []change, options Options) (int, int, int, int, error) {
+	revs := make(map[string][]string)
+	for i := 0; i < len(changes); i++ {
+		for j := 0; j < len(changes[i].Changes); j++ {
+			revs[changes[i].Id] = append(revs[changes[i].Id], changes[i].Changes[j].Rev)
+		}
+	}
+	status, body, err := request(httpClient, "POST", target, "/_revs_diff", revs)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if status != 200 {
+		return 0, 0, 0, 0, errors.New("_revs_diff failed on " + redact(target.Url) + ": " + string(body))
+	}
+	var diff revsDiff
+	json.Unmarshal(body, &diff)
+	if len(diff) == 0 {
+		return 0, 0, 0, 0, nil
+	}
+	docs, unread, err := getMissingRevisions(httpClient, source, diff)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	read := len(docs)
+	if read == 0 {
+		return 0, 0, unread, 0, nil
+	}
+	if options.Transform != nil {
+		for i := 0; i < len(docs); i++ {
+			docs[i] = options.Transform(docs[i])
+		}
+	}
+	status, body, err = request(httpClient, "POST", target, "/_bulk_docs",
+		map[string]interface{}{"docs": docs, "new_edits": false})
+	if err != nil {
+		return 0, 0, unread, read, err
+	}
+	if status != 201 && status != 202 {
+		return 0, 0, unread, read, errors.New("_bulk_docs failed on " + redact(target.Url) + ": " + string(body))
+	}
+	var results []map[string]interface{}
+	json.Unmarshal(body, &results)
+	failures := 0
+	for i := 0; i < len(results); i++ {
+		if results[i]["error"] != nil {
+			failures += 1
+		}
+	}
+	return len(docs) - failures, failures, unread, read, nil
+}
+
+/*
+*	Fetches the missing revisions, with their revision history and
+*	attachments, through _bulk_get. Falls back to one open_revs
+*	request per document when the source doesn't support _bulk_get.
+*	Also returns the number of revisions the source answered with an
+*	error or as missing.
+ */
+func getMissingRevisions(httpClient *http.Client, source Endpoint, diff revsDiff) ([]map[string]interface{}, int, error) {
+	var docs []map[string]interface{}
+	var requested []map[string]string
+	for id, revs := range diff {
+		for i := 0; i < len(revs.Missing); i++ {
+			requested = append(requested, map[string]string{"id": id, "rev": revs.Missing[i]})
+		}
+	}
+	status, body, err := request(httpClient, "POST", source, "/_bulk_get?revs=true&attachments=true",
+		map[string]interface{}{"docs": requested})
+	if err != nil {
+		return docs, 0, err
+	}
+	unread := 0
+	if status == 200 {
+		var bulk struct {
+			Results []struct {
+				Docs []struct {
+					Ok map[string]interface{} `json:"ok"`
+				} `json:"docs"`
+			} `json:"results"`
+		}
+		err = json.Unmarshal(body, &bulk)
+		if err != nil {
+			return docs, 0, err
+		}
+		for i := 0; i < len(bulk.Results); i++ {
+			for j := 0; j < len(bulk.Results[i].Docs); j++ {
+				if bulk.Results[i].Docs[j].Ok != nil {
+					docs = append(docs, bulk.Results[i].Docs[j].Ok)
+				} else {
+					unread += 1
+				}
+			}
+		}
+		if len(docs)+unread < len(requested) {
+			unread = len(requested) - len(docs)
+		}
+		return docs, unread, nil
+	}
+	for id, revs := range diff {
+		openRevs, _ := json.Marshal(revs.Missing)
+		path := "/" + url.PathEscape(id) + "?revs=true&attachments=true&latest=true&open_revs=" + url.QueryEscape(string(openRevs))
+		status, body, err := request(httpClient, "GET", source, path, nil)
+		if err != nil {
+			return docs, unread, err
+		}
+		if status != 200 {
+			return docs, unread, errors.New("Unable to read " + id + " from " + redact(source.Url) + ": " + string(body))
+		}
+		var revisions []struct {
+			Ok map[string]interface{} `json:"ok"`
+		}
+		json.Unmarshal(body, &revisions)
+		for i := 0; i < len(revisions); i++ {
+			if revisions[i].Ok != nil {
+				docs = append(docs, revisions[i].Ok)
+			} else {
+				unread += 1
+			}
+		}
+	}
+	return docs, unread, nil
+}
+
+/*
+*	Returns the sequence to start from. The checkpoint of the target
+*	is used unless the source has one from a different session, in
+*	which case one of the two databases was replaced and the
+*	replication starts from the beginning.
+ */
+func getCheckpoint(httpClient *http.Client, source Endpoint, target Endpoint, repId string, targetOnly bool) interface{} {
+	targetCheckpoint := getLocalDocument(httpClient, target, repId)
+	if targetCheckpoint == nil {
+		return nil
+	}
+	if targetOnly {
+		return targetCheckpoint["source_last_seq"]
+	}
+	sourceCheckpoint := getLocalDocument(httpClient, source, repId)
+	if sourceCheckpoint != nil && sourceCheckpoint["session_id"] != targetCheckpoint["session_id"] {
+		return nil
+	}
+	return targetCheckpoint["source_last_seq"]
+}
+
+/*
+*	Records seq as the checkpoint on both sides, or only on the target
+*	with targetOnly. A source that can't be written to only keeps the
+*	target's checkpoint.
+ */
+func saveCheckpoint(httpClient *http.Client, source Endpoint, target Endpoint, repId string, sessionId string, seq interface{}, targetOnly bool) {
+	endpoints := []Endpoint{source, target}
+	if targetOnly {
+		endpoints = []Endpoint{target}
+	}
+	for i := 0; i < len(endpoints); i++ {
+		checkpoint := map[string]interface{}{"session_id": sessionId, "source_last_seq": seq}
+		existing := getLocalDocument(httpClient, endpoints[i], repId)
+		if existing != nil {
+			checkpoint["_rev"] = existing["_rev"]
+		}
+		request(httpClient, "PUT", endpoints[i], "/_local/"+repId, checkpoint)
+	}
+}
+
+func getLocalDocument(httpClient *http.Client, endpoint Endpoint, repId string) map[string]interface{} {
+	status, body, err := request(httpClient, "GET", endpoint, "/_local/"+repId, nil)
+	if err != nil || status != 200 {
+		return nil
+	}
+	var doc map[string]interface{}
+	json.Unmarshal(body, &doc)
+	return doc
+}
+
+func countFilters(options Options) int {
+	used := 0
+	if len(options.DocIds) > 0 {
+		used += 1
+	}
+	if options.Selector != nil {
+		used += 1
+	}
+	if options.Filter != "" {
+		used += 1
+	}
+	return used
+}
+
+/*
+*	The replication id only depends on the databases and the
+*	documents replicated, not on the credentials used to reach them
+ */
+func getReplicationId(source Endpoint, target Endpoint, options Options) string {
+	key := "bc-replicator|" + redact(source.Url) + "|" + redact(target.Url)
+	if len(options.DocIds) > 0 {
+		ids := append([]string{}, options.DocIds...)
+		sort.Strings(ids)
+		key += "|" + strings.Join(ids, ",")
+	}
+	if options.Selector != nil {
+		selector, _ := json.Marshal(options.Selector)
+		key += "|selector|" + string(selector)
+	}
+	if options.Filter != "" {
+		params, _ := json.Marshal(options.QueryParams)
+		key += "|filter|" + options.Filter + "|" + string(params)
+	}
+	sum := md5.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func seqString(seq interface{}) string {
+	if s, ok := seq.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(seq)
+	return string(b)
+}
+
+/*
+*	Removes the credentials from a URL so it can be shown to the user
+ */
+func redact(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	parsed.User = nil
+	return parsed.String()
+}
+
+func request(httpClient *http.Client, method string, endpoint Endpoint, path string, body interface{}) (int, []byte, error) {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(endpoint.Url, "/")+path, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for header, value := range endpoint.Headers {
+		req.Header.Set(header, value)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, errors.New(method + " " + redact(endpoint.Url) + path + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
@@ -0,0 +1,270 @@
+package bcr_replicator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+*	A CouchDB server holding just enough of the API for the
+*	replicator: every write of a document appends a revision to the
+*	database, and its position is the update sequence.
+ */
+type fakeCouch struct {
+	mu          sync.Mutex
+	dbs         map[string]*fakeDb
+	unreadable  map[string]bool
+	failChanges bool
+	since       []string
+}
+
+type fakeDb struct {
+	revs  []map[string]interface{}
+	local map[string]map[string]interface{}
+}
+
+func newFakeCouch(dbs ...string) *fakeCouch {
+	couch := &fakeCouch{dbs: make(map[string]*fakeDb), unreadable: make(map[string]bool)}
+	for i := 0; i < len(dbs); i++ {
+		couch.dbs[dbs[i]] = &fakeDb{local: make(map[string]map[string]interface{})}
+	}
+	return couch
+}
+
+func (couch *fakeCouch) addDoc(db string, id string, rev string) {
+	couch.mu.Lock()
+	defer couch.mu.Unlock()
+	couch.dbs[db].revs = append(couch.dbs[db].revs, map[string]interface{}{"_id": id, "_rev": rev})
+}
+
+func (db *fakeDb) hasRev(id string, rev string) bool {
+	for i := 0; i < len(db.revs); i++ {
+		if db.revs[i]["_id"] == id && db.revs[i]["_rev"] == rev {
+			return true
+		}
+	}
+	return false
+}
+
+func (couch *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	couch.mu.Lock()
+	defer couch.mu.Unlock()
+	split_path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	db, found := couch.dbs[split_path[0]]
+	if !found {
+		writeJSON(w, 404, map[string]string{"error": "not_found"})
+		return
+	}
+	var body map[string]interface{}
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(reqBody, &body)
+	path := ""
+	if len(split_path) == 2 {
+		path = split_path[1]
+	}
+	switch {
+	case path == "":
+		writeJSON(w, 200, map[string]interface{}{"update_seq": len(db.revs)})
+	case path == "_changes":
+		couch.since = append(couch.since, r.URL.Query().Get("since"))
+		if couch.failChanges {
+			writeJSON(w, 500, map[string]string{"error": "unavailable"})
+			return
+		}
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		var results []map[string]interface{}
+		lastSeq := since
+		for i := since; i < len(db.revs) && len(results) < limit; i++ {
+			lastSeq = i + 1
+			results = append(results, map[string]interface{}{"seq": lastSeq, "id": db.revs[i]["_id"],
+				"changes": []map[string]interface{}{{"rev": db.revs[i]["_rev"]}}})
+		}
+		writeJSON(w, 200, map[string]interface{}{"results": results, "last_seq": lastSeq})
+	case path == "_revs_diff":
+		diff := make(map[string]map[string][]string)
+		for id, revs := range body {
+			revList, _ := revs.([]interface{})
+			for i := 0; i < len(revList); i++ {
+				if rev, _ := revList[i].(string); !db.hasRev(id, rev) {
+					if diff[id] == nil {
+						diff[id] = map[string][]string{"missing": []string{}}
+					}
+					diff[id]["missing"] = append(diff[id]["missing"], rev)
+				}
+			}
+		}
+		writeJSON(w, 200, diff)
+	case path == "_bulk_get":
+		var results []map[string]interface{}
+		requested, _ := body["docs"].([]interface{})
+		for i := 0; i < len(requested); i++ {
+			req, _ := requested[i].(map[string]interface{})
+			id, _ := req["id"].(string)
+			rev, _ := req["rev"].(string)
+			entry := map[string]interface{}{"ok": map[string]interface{}{"_id": id, "_rev": rev}}
+			if couch.unreadable[id] || !db.hasRev(id, rev) {
+				entry = map[string]interface{}{"error": map[string]interface{}{"id": id, "rev": rev, "error": "not_found"}}
+			}
+			results = append(results, map[string]interface{}{"id": id, "docs": []interface{}{entry}})
+		}
+		writeJSON(w, 200, map[string]interface{}{"results": results})
+	case path == "_bulk_docs":
+		docs, _ := body["docs"].([]interface{})
+		var results []map[string]interface{}
+		for i := 0; i < len(docs); i++ {
+			doc, _ := docs[i].(map[string]interface{})
+			db.revs = append(db.revs, doc)
+			results = append(results, map[string]interface{}{"ok": true, "id": doc["_id"]})
+		}
+		writeJSON(w, 201, results)
+	case strings.HasPrefix(path, "_local/"):
+		id := strings.TrimPrefix(path, "_local/")
+		if r.Method == "PUT" {
+			body["_rev"] = "0-1"
+			db.local[id] = body
+			writeJSON(w, 201, map[string]interface{}{"ok": true})
+		} else if doc, found := db.local[id]; found {
+			writeJSON(w, 200, doc)
+		} else {
+			writeJSON(w, 404, map[string]string{"error": "not_found"})
+		}
+	default:
+		writeJSON(w, 404, map[string]string{"error": "not_found"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestReplicateResumesFromCheckpoint(t *testing.T) {
+	couch := newFakeCouch("source", "target")
+	server := httptest.NewServer(couch)
+	defer server.Close()
+	source := Endpoint{Url: server.URL + "/source"}
+	target := Endpoint{Url: server.URL + "/target"}
+	couch.addDoc("source", "a", "1-a")
+	couch.addDoc("source", "b", "1-b")
+	result, err := Replicate(http.DefaultClient, source, target, Options{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DocsWritten != 2 || result.DocWriteFailures != 0 {
+		t.Fatalf("first run wrote %d documents with %d failures, expected 2 and 0", result.DocsWritten, result.DocWriteFailures)
+	}
+	couch.addDoc("source", "c", "1-c")
+	couch.since = nil
+	result, err = Replicate(http.DefaultClient, source, target, Options{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DocsRead != 1 || result.DocsWritten != 1 {
+		t.Fatalf("second run read %d and wrote %d documents, expected 1 and 1", result.DocsRead, result.DocsWritten)
+	}
+	if len(couch.since) == 0 || couch.since[0] != "2" {
+		t.Fatalf("second run started from %v, expected the checkpoint 2", couch.since)
+	}
+	if !couch.dbs["target"].hasRev("c", "1-c") {
+		t.Fatal("the new document was not written to the target")
+	}
+}
+
+func TestReplicateDoesNotCheckpointPastUnreadRevisions(t *testing.T) {
+	couch := newFakeCouch("source", "target")
+	server := httptest.NewServer(couch)
+	defer server.Close()
+	source := Endpoint{Url: server.URL + "/source"}
+	target := Endpoint{Url: server.URL + "/target"}
+	couch.addDoc("source", "a", "1-a")
+	couch.addDoc("source", "b", "1-b")
+	couch.addDoc("source", "c", "1-c")
+	couch.unreadable["b"] = true
+	result, err := Replicate(http.DefaultClient, source, target, Options{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DocsWritten != 2 || result.DocWriteFailures != 1 {
+		t.Fatalf("wrote %d documents with %d failures, expected 2 and 1", result.DocsWritten, result.DocWriteFailures)
+	}
+	repId := getReplicationId(source, target, Options{})
+	checkpoint := couch.dbs["target"].local[repId]
+	if checkpoint == nil || checkpoint["source_last_seq"] != float64(1) {
+		t.Fatalf("checkpoint is %v, expected it to stay at 1", checkpoint)
+	}
+	delete(couch.unreadable, "b")
+	result, err = Replicate(http.DefaultClient, source, target, Options{BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DocsWritten != 1 || result.DocWriteFailures != 0 || !couch.dbs["target"].hasRev("b", "1-b") {
+		t.Fatalf("retry wrote %d documents with %d failures, expected the unread revision to be written", result.DocsWritten,
+			result.DocWriteFailures)
+	}
+}
+
+func TestContinuousReplicationRetries(t *testing.T) {
+	couch := newFakeCouch("source", "target")
+	couch.failChanges = true
+	server := httptest.NewServer(couch)
+	defer server.Close()
+	maxRetries, retryDelay := MAX_RETRIES, RETRY_DELAY
+	MAX_RETRIES, RETRY_DELAY = 2, time.Millisecond
+	defer func() { MAX_RETRIES, RETRY_DELAY = maxRetries, retryDelay }()
+	done := make(chan error)
+	go func() {
+		_, err := Replicate(http.DefaultClient, Endpoint{Url: server.URL + "/source"}, Endpoint{Url: server.URL + "/target"},
+			Options{Continuous: true})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the replication to give up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replication did not give up")
+	}
+	if len(couch.since) != 3 {
+		t.Fatalf("_changes was read %d times, expected 3", len(couch.since))
+	}
+}
+
+func TestTargetCheckpointOnly(t *testing.T) {
+	couch := newFakeCouch("source", "target")
+	server := httptest.NewServer(couch)
+	defer server.Close()
+	source := Endpoint{Url: server.URL + "/source"}
+	target := Endpoint{Url: server.URL + "/target"}
+	couch.addDoc("source", "a", "1-a")
+	result, err := Replicate(http.DefaultClient, source, target, Options{TargetCheckpointOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DocsWritten != 1 {
+		t.Fatalf("wrote %d documents, expected 1", result.DocsWritten)
+	}
+	if len(couch.dbs["source"].local) != 0 {
+		t.Fatalf("checkpoints were written to the source: %v", couch.dbs["source"].local)
+	}
+	if len(couch.dbs["target"].local) != 1 {
+		t.Fatal("no checkpoint was written to the target")
+	}
+	couch.since = nil
+	_, err = Replicate(http.DefaultClient, source, target, Options{TargetCheckpointOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(couch.since) == 0 || couch.since[0] != "1" {
+		t.Fatalf("second run started from %v, expected the checkpoint 1", couch.since)
+	}
+}
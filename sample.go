@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/replicator"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+*	Number of documents read per _all_docs request when following
+*	references
+ */
+var SAMPLE_BATCH_SIZE = 500
+
+/*
+*	Copies a sample of the documents of each database from the region
+*	passed with --from to the one passed with --to, possibly of
+*	another app. Each document is picked by a hash of the seed and its
+*	ID, so the same seed always gives the same sample. Documents
+*	referenced by the fields passed with --ref-fields are copied along.
+*	The copy is checked against --policy and redacted with the rule
+*	of the target region in --redaction-rules, and nothing is written
+*	to the source.
+ */
+func sample(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if flags.From == "" || flags.To == "" {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the regions to copy from and to with '" + terminal.ColorizeBold("--from", 33) +
+			"' and '" + terminal.ColorizeBold("--to", 33) + "'. For help look to '" + terminal.ColorizeBold("cf help cloudant-sample", 33) + "'"))
+	}
+	if (flags.Percent == 0) == (flags.Count == 0) {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass either '" + terminal.ColorizeBold("--percent", 33) + "' or '" +
+			terminal.ColorizeBold("--count", 33) + "'"))
+	}
+	if len(flags.Dbs) == 0 {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the databases to sample with '" + terminal.ColorizeBold("-d", 33) + "'"))
+	}
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	targetApp, targetAccounts := appname, cloudantAccounts
+	if flags.ToApp != "" && flags.ToApp != appname {
+		targetApp = flags.ToApp
+		targetAccounts, err = ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, targetApp, password)
+		bcr_utils.CheckErrorFatal(err)
+	}
+	source, found := bcr_utils.FindAccount(flags.From, cloudantAccounts)
+	if !found {
+		bcr_utils.CheckErrorFatal(errors.New("No Cloudant service was found for '" + terminal.ColorizeBold(appname, 36) +
+			"' in region '" + terminal.ColorizeBold(flags.From, 36) + "'"))
+	}
+	target, found := bcr_utils.FindAccount(flags.To, targetAccounts)
+	if !found {
+		bcr_utils.CheckErrorFatal(errors.New("No Cloudant service was found for '" + terminal.ColorizeBold(targetApp, 36) +
+			"' in region '" + terminal.ColorizeBold(flags.To, 36) + "'"))
+	}
+	if source.Username == target.Username {
+		bcr_utils.CheckErrorFatal(errors.New("The sample has to be copied to another Cloudant account"))
+	}
+	rules, err := readRedactionRules(flags.RedactionRules, targetAccounts)
+	bcr_utils.CheckErrorFatal(err)
+	policy, err := readPolicy(flags.Policy)
+	bcr_utils.CheckErrorFatal(err)
+	var violations []string
+	for i := 0; i < len(flags.Dbs); i++ {
+		var created []cam.CloudantAccount
+		if flags.Create {
+			created = append(created, target)
+		}
+		violations = append(violations, getPolicyViolations(policy, flags.Dbs[i], created, nil,
+			[]Replication{Replication{Source: source, Target: target}}, "pull")...)
+	}
+	enforcePolicy(violations, flags.Policy)
+	options := bcr_replicator.Options{CreateTarget: flags.Create, TargetCheckpointOnly: true}
+	if rule, found := rules[target.Username]; found {
+		options.Transform = redactDocument(rule)
+	}
+	var lines []string
+	for i := 0; i < len(flags.Dbs); i++ {
+		db := flags.Dbs[i]
+		fmt.Println("\nSampling '" + terminal.ColorizeBold(db, 36) + "' in '" + terminal.ColorizeBold(source.Endpoint, 36) + "'\n")
+		ids, err := getSampleIds(httpClient, source, db, flags)
+		if bcr_utils.CheckErrorNonFatal(err) {
+			continue
+		}
+		numSampled := len(ids)
+		ids, err = addReferencedIds(httpClient, source, db, ids, flags.RefFields)
+		if bcr_utils.CheckErrorNonFatal(err) {
+			continue
+		}
+		line := terminal.ColorizeBold(db, 36) + ": " + strconv.Itoa(numSampled) + " sampled and " +
+			strconv.Itoa(len(ids)-numSampled) + " referenced documents, "
+		if len(ids) == 0 {
+			lines = append(lines, line+"nothing to copy")
+			continue
+		}
+		options.DocIds = ids
+		r, err := bcr_replicator.Replicate(httpClient, getLocalEndpoint(source, db), getLocalEndpoint(target, db), options)
+		if bcr_utils.CheckErrorNonFatal(err) {
+			lines = append(lines, line+terminal.ColorizeBold("error", 31)+" "+err.Error())
+			continue
+		}
+		lines = append(lines, line+strconv.Itoa(r.DocsWritten)+" docs written, "+strconv.Itoa(r.DocWriteFailures)+" failures")
+	}
+	deleteCookies(httpClient, cloudantAccounts)
+	if targetApp != appname {
+		deleteCookies(httpClient, targetAccounts)
+	}
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	if _, found := rules[target.Username]; found {
+		fmt.Println("\nThe documents were redacted with the rules for '" + terminal.ColorizeBold(target.Endpoint, 36) + "'")
+	}
+	fmt.Println("\nA sample with seed '" + terminal.ColorizeBold(flags.Seed, 36) + "' was copied from '" +
+		terminal.ColorizeBold(source.Endpoint, 36) + "' of '" + terminal.ColorizeBold(appname, 36) + "' to '" +
+		terminal.ColorizeBold(target.Endpoint, 36) + "' of '" + terminal.ColorizeBold(targetApp, 36) + "':\n")
+	for i := 0; i < len(lines); i++ {
+		fmt.Println(lines[i])
+	}
+}
+
+/*
+*	Returns the IDs of the sampled documents of db. Design documents
+*	are never sampled. With --percent each document is kept when its
+*	hash falls in that share of the hash space, with --count the
+*	documents with the lowest hashes are kept.
+ */
+func getSampleIds(httpClient *http.Client, account cam.CloudantAccount, db string, flags bcr_utils.Flags) ([]string, error) {
+	var ids []string
+	allDocsUrl := "https://" + account.Username + ".cloudant.com/" + url.PathEscape(db) + "/_all_docs"
+	headers := map[string]string{"Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", allDocsUrl, "", headers)
+	if err != nil {
+		return ids, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 {
+		return ids, errors.New("Unable to read the documents of '" + terminal.ColorizeBold(db, 36) + "' in '" +
+			terminal.ColorizeBold(account.Endpoint, 36) + "'")
+	}
+	var all_docs struct {
+		Rows []struct {
+			Id string `json:"id"`
+		} `json:"rows"`
+	}
+	json.Unmarshal(respBody, &all_docs)
+	hashes := make(map[string]uint64)
+	for i := 0; i < len(all_docs.Rows); i++ {
+		id := all_docs.Rows[i].Id
+		if strings.HasPrefix(id, "_design/") {
+			continue
+		}
+		hashes[id] = getSampleHash(flags.Seed, id)
+		if flags.Percent > 0 && float64(hashes[id]%1000000) < flags.Percent*10000 {
+			ids = append(ids, id)
+		} else if flags.Count > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if flags.Count > 0 {
+		sort.Slice(ids, func(i, j int) bool {
+			if hashes[ids[i]] == hashes[ids[j]] {
+				return ids[i] < ids[j]
+			}
+			return hashes[ids[i]] < hashes[ids[j]]
+		})
+		if len(ids) > flags.Count {
+			ids = ids[:flags.Count]
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func getSampleHash(seed string, id string) uint64 {
+	sum := sha256.Sum256([]byte(seed + "\x00" + id))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+/*
+*	Adds the documents referenced by refFields in the documents of
+*	ids, and the ones they reference in turn. References to documents
+*	that don't exist are ignored.
+ */
+func addReferencedIds(httpClient *http.Client, account cam.CloudantAccount, db string, ids []string, refFields []string) ([]string, error) {
+	if len(refFields) == 0 {
+		return ids, nil
+	}
+	selected := make(map[string]bool)
+	for i := 0; i < len(ids); i++ {
+		selected[ids[i]] = true
+	}
+	frontier := ids
+	for len(frontier) > 0 {
+		var next []string
+		for start := 0; start < len(frontier); start += SAMPLE_BATCH_SIZE {
+			end := start + SAMPLE_BATCH_SIZE
+			if end > len(frontier) {
+				end = len(frontier)
+			}
+			docs, err := getDocuments(httpClient, account, db, frontier[start:end])
+			if err != nil {
+				return ids, err
+			}
+			for j := start; j < end; j++ {
+				doc, found := docs[frontier[j]]
+				if !found {
+					delete(selected, frontier[j])
+					continue
+				}
+				for k := 0; k < len(refFields); k++ {
+					refs := getReferences(doc, strings.Split(refFields[k], "."))
+					for l := 0; l < len(refs); l++ {
+						if !selected[refs[l]] {
+							selected[refs[l]] = true
+							next = append(next, refs[l])
+						}
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+	var all_ids []string
+	for id := range selected {
+		all_ids = append(all_ids, id)
+	}
+	sort.Strings(all_ids)
+	return all_ids, nil
+}
+
+/*
+*	Reads the documents of db with the given IDs. Documents that
+*	don't exist or were deleted are left out.
+ */
+func getDocuments(httpClient *http.Client, account cam.CloudantAccount, db string, ids []string) (map[string]map[string]interface{}, error) {
+	docs := make(map[string]map[string]interface{})
+	docsUrl := "https://" + account.Username + ".cloudant.com/" + url.PathEscape(db) + "/_all_docs?include_docs=true"
+	headers := map[string]string{"Cookie": account.Cookie, "Content-Type": "application/json"}
+	body, _ := json.Marshal(map[string][]string{"keys": ids})
+	resp, err := bcr_utils.MakeRequest(httpClient, "POST", docsUrl, string(body), headers)
+	if err != nil {
+		return docs, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 {
+		return docs, errors.New("Unable to read the documents of '" + terminal.ColorizeBold(db, 36) + "' in '" +
+			terminal.ColorizeBold(account.Endpoint, 36) + "'")
+	}
+	var all_docs struct {
+		Rows []struct {
+			Id  string                 `json:"id"`
+			Doc map[string]interface{} `json:"doc"`
+		} `json:"rows"`
+	}
+	json.Unmarshal(respBody, &all_docs)
+	for i := 0; i < len(all_docs.Rows); i++ {
+		if all_docs.Rows[i].Doc != nil {
+			docs[all_docs.Rows[i].Id] = all_docs.Rows[i].Doc
+		}
+	}
+	return docs, nil
+}
+
+/*
+*	Returns the document IDs found at path in obj. The field may hold
+*	a single ID or an array of them, and arrays on the way are walked
+*	element by element.
+ */
+func getReferences(obj interface{}, path []string) []string {
+	var refs []string
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return refs
+		}
+		return getReferences(v[path[0]], path[1:])
+	case []interface{}:
+		for i := 0; i < len(v); i++ {
+			refs = append(refs, getReferences(v[i], path)...)
+		}
+	case string:
+		if len(path) == 0 && v != "" {
+			refs = append(refs, v)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+*	Sends every request to server, whatever account URL it was made
+*	for
+ */
+type serverTransport struct {
+	server *httptest.Server
+}
+
+func (transport serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverUrl, _ := url.Parse(transport.server.URL)
+	req.URL.Scheme = serverUrl.Scheme
+	req.URL.Host = serverUrl.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+/*
+*	A database answering _all_docs, by GET for every document and by
+*	POST for the keys asked for
+ */
+func newSampleServer(db string, docs map[string]map[string]interface{}) (*httptest.Server, *http.Client) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+db+"/_all_docs" {
+			w.WriteHeader(404)
+			return
+		}
+		var rows []map[string]interface{}
+		if r.Method == "GET" {
+			for id := range docs {
+				rows = append(rows, map[string]interface{}{"id": id, "key": id})
+			}
+		} else {
+			var body struct {
+				Keys []string `json:"keys"`
+			}
+			reqBody, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(reqBody, &body)
+			for i := 0; i < len(body.Keys); i++ {
+				if doc, found := docs[body.Keys[i]]; found {
+					rows = append(rows, map[string]interface{}{"id": body.Keys[i], "key": body.Keys[i], "doc": doc})
+				} else {
+					rows = append(rows, map[string]interface{}{"key": body.Keys[i], "error": "not_found"})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	}))
+	return server, &http.Client{Transport: serverTransport{server: server}}
+}
+
+var sampleAccount = cam.CloudantAccount{Username: "acct-ng", Endpoint: "https://api.ng.bluemix.net"}
+
+func TestGetSampleIds(t *testing.T) {
+	docs := make(map[string]map[string]interface{})
+	for i := 0; i < 200; i++ {
+		id := "doc-" + strconv.Itoa(i)
+		docs[id] = map[string]interface{}{"_id": id}
+	}
+	docs["_design/app"] = map[string]interface{}{"_id": "_design/app"}
+	server, httpClient := newSampleServer("orders", docs)
+	defer server.Close()
+	tests := []struct {
+		name  string
+		flags bcr_utils.Flags
+		count int
+	}{
+		{"count", bcr_utils.Flags{Count: 25, Seed: "a"}, 25},
+		{"count above the documents", bcr_utils.Flags{Count: 500, Seed: "a"}, 200},
+		{"percent", bcr_utils.Flags{Percent: 20, Seed: "a"}, -1},
+	}
+	for i := 0; i < len(tests); i++ {
+		ids, err := getSampleIds(httpClient, sampleAccount, "orders", tests[i].flags)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tests[i].name, err)
+		}
+		again, _ := getSampleIds(httpClient, sampleAccount, "orders", tests[i].flags)
+		if !reflect.DeepEqual(ids, again) {
+			t.Fatalf("%s: the same seed gave %v and %v", tests[i].name, ids, again)
+		}
+		if tests[i].count >= 0 && len(ids) != tests[i].count {
+			t.Fatalf("%s: expected %d documents, got %d", tests[i].name, tests[i].count, len(ids))
+		}
+		if tests[i].count < 0 && (len(ids) == 0 || len(ids) == 200) {
+			t.Fatalf("%s: expected a part of the documents, got %d", tests[i].name, len(ids))
+		}
+		for j := 0; j < len(ids); j++ {
+			if strings.HasPrefix(ids[j], "_design/") {
+				t.Fatalf("%s: sampled design document %s", tests[i].name, ids[j])
+			}
+		}
+		otherFlags := tests[i].flags
+		otherFlags.Seed = "b"
+		other, _ := getSampleIds(httpClient, sampleAccount, "orders", otherFlags)
+		if tests[i].count != 200 && reflect.DeepEqual(ids, other) {
+			t.Fatalf("%s: seeds a and b gave the same sample", tests[i].name)
+		}
+	}
+}
+
+func TestAddReferencedIds(t *testing.T) {
+	docs := map[string]map[string]interface{}{
+		"order-1":    {"_id": "order-1", "customer": "customer-1", "items": []interface{}{map[string]interface{}{"product": "product-1"}}},
+		"order-2":    {"_id": "order-2", "customer": "customer-2", "items": []interface{}{}},
+		"customer-1": {"_id": "customer-1", "referrer": "customer-3"},
+		"customer-2": {"_id": "customer-2"},
+		"customer-3": {"_id": "customer-3", "referrer": "customer-1"},
+		"product-1":  {"_id": "product-1", "supplier": "supplier-gone"},
+	}
+	server, httpClient := newSampleServer("orders", docs)
+	defer server.Close()
+	tests := []struct {
+		name      string
+		ids       []string
+		refFields []string
+		expected  []string
+	}{
+		{"no reference fields", []string{"order-1"}, nil, []string{"order-1"}},
+		{"single field", []string{"order-1"}, []string{"customer"}, []string{"customer-1", "order-1"}},
+		{"references of references", []string{"order-1"}, []string{"customer", "referrer"},
+			[]string{"customer-1", "customer-3", "order-1"}},
+		{"nested field in an array", []string{"order-1"}, []string{"items.product"}, []string{"order-1", "product-1"}},
+		{"missing documents are ignored", []string{"order-1", "order-2"}, []string{"customer", "items.product", "supplier"},
+			[]string{"customer-1", "customer-2", "order-1", "order-2", "product-1"}},
+	}
+	for i := 0; i < len(tests); i++ {
+		ids, err := addReferencedIds(httpClient, sampleAccount, "orders", tests[i].ids, tests[i].refFields)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tests[i].name, err)
+		}
+		if !reflect.DeepEqual(ids, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].name, tests[i].expected, ids)
+		}
+	}
+}
+
+func TestGetReferences(t *testing.T) {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"a":"x","b":["y","z",""],"c":[{"d":"v"},{"d":["w"]},{"e":"u"}],"f":{"g":"t"},"h":1}`), &doc)
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"a", []string{"x"}},
+		{"b", []string{"y", "z"}},
+		{"c.d", []string{"v", "w"}},
+		{"f.g", []string{"t"}},
+		{"f", nil},
+		{"h", nil},
+		{"missing", nil},
+	}
+	for i := 0; i < len(tests); i++ {
+		if refs := getReferences(doc, strings.Split(tests[i].path, ".")); !reflect.DeepEqual(refs, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].path, tests[i].expected, refs)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+*	The _security document of a database in one of the two models.
+*	"cloudant" documents live at /_api/v2/db/<db>/_security and hold
+*	the roles of each username in their cloudant section. "couchdb"
+*	documents live at /<db>/_security and list the names and roles of
+*	their admins and members, as used by accounts set to
+*	couchdb_auth_only and by plain CouchDB.
+ */
+type Security struct {
+	Model  string
+	Body   string
+	Parsed map[string]interface{}
+}
+
+/*
+*	The field of a _security document that lists the principals the
+*	plugin added, so that members added by hand are never removed and
+*	grants the plugin made can be told apart from the app's own
+ */
+var PLUGIN_MEMBERS_FIELD = "bc_replicator_members"
+
+func getSecurityUrl(account cam.CloudantAccount, db string, model string) string {
+	if model == "couchdb" {
+		return "https://" + account.Username + ".cloudant.com/" + url.PathEscape(db) + "/_security"
+	}
+	return "https://" + account.Username + ".cloudant.com/_api/v2/db/" + db + "/_security"
+}
+
+/*
+*	Reads the _security document of db and detects the model the
+*	account uses for it. The response of the last request is returned
+*	so that callers can tell a missing database apart.
+ */
+func getSecurity(db string, httpClient *http.Client, account cam.CloudantAccount) (Security, bcr_utils.HttpResponse) {
+	sec := Security{Model: "cloudant"}
+	r := getPermissions(db, httpClient, account)
+	split_status := strings.Split(r.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status == 200 && r.Err == nil {
+		json.Unmarshal([]byte(r.Body), &sec.Parsed)
+		if authOnly, _ := sec.Parsed["couchdb_auth_only"].(bool); !authOnly {
+			sec.Body = r.Body
+			if sec.Parsed == nil {
+				sec.Parsed = make(map[string]interface{})
+			}
+			return sec, r
+		}
+	}
+	couchR := getCouchDBPermissions(db, httpClient, account)
+	split_status = strings.Split(couchR.Status, " ")[0]
+	couchStatus, _ := strconv.Atoi(split_status)
+	if couchStatus != 200 || couchR.Err != nil {
+		if status == 200 && r.Err == nil {
+			return sec, couchR
+		}
+		return sec, r
+	}
+	sec = Security{Model: "couchdb", Body: couchR.Body}
+	json.Unmarshal([]byte(couchR.Body), &sec.Parsed)
+	if sec.Parsed == nil {
+		sec.Parsed = make(map[string]interface{})
+	}
+	return sec, couchR
+}
+
+func getCouchDBPermissions(db string, httpClient *http.Client, account cam.CloudantAccount) bcr_utils.HttpResponse {
+	headers := map[string]string{"Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", getSecurityUrl(account, db, "couchdb"), "", headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "GET", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return bcr_utils.HttpResponse{RequestType: "GET", Status: resp.Status, Body: string(respBody), Err: err}
+}
+
+/*
+*	Gives username the roles. A username the document didn't name yet
+*	is recorded as added by the plugin. In the couchdb model, which has
+*	no per-user roles, username is made a member. A public database,
+*	which has no members, is left as it is since its first member
+*	would lock everyone else out. Returns whether the document changed.
+ */
+func addGrants(sec Security, username string, roles []string) bool {
+	if len(roles) == 0 {
+		return false
+	}
+	if sec.Model == "couchdb" {
+		names := getSecurityNames(sec, "members")
+		if isPublicDatabase(sec) || bcr_utils.IsValid(username, names) {
+			return false
+		}
+		setSecurityNames(sec, "members", append(names, username))
+		sec.Parsed[PLUGIN_MEMBERS_FIELD] = append(getPluginMembers(sec), username)
+		return true
+	}
+	cloudant := getCloudantSection(sec)
+	currPerms, found := cloudant[username].([]interface{})
+	if !found && !bcr_utils.IsValid(username, getPluginMembers(sec)) {
+		sec.Parsed[PLUGIN_MEMBERS_FIELD] = append(getPluginMembers(sec), username)
+	}
+	changed := false
+	for i := 0; i < len(roles); i++ {
+		addRole := true
+		for j := 0; j < len(currPerms); j++ {
+			if role, _ := currPerms[j].(string); role == roles[i] {
+				addRole = false
+			}
+		}
+		if addRole {
+			currPerms = append(currPerms, roles[i])
+			changed = true
+		}
+	}
+	cloudant[username] = currPerms
+	return changed
+}
+
+/*
+*	Takes away the roles of username that the plugin grants, except
+*	the ones in keep. In the couchdb model username stops being a
+*	member when it needs no role at all, if the plugin made it one.
+*	Returns the removed roles.
+ */
+func removeGrants(sec Security, username string, keep []string) []string {
+	var removed []string
+	if sec.Model == "couchdb" {
+		if len(keep) == 0 && bcr_utils.IsValid(username, getPluginMembers(sec)) {
+			forgetPluginMember(sec, username)
+			if removeSecurityName(sec, "members", username) {
+				removed = append(removed, "member")
+			}
+		}
+		return removed
+	}
+	cloudant := getCloudantSection(sec)
+	currPerms, found := cloudant[username].([]interface{})
+	if !found {
+		return removed
+	}
+	var kept []interface{}
+	for i := 0; i < len(currPerms); i++ {
+		role, _ := currPerms[i].(string)
+		if bcr_utils.IsValid(role, GRANTED_ROLES) && !bcr_utils.IsValid(role, keep) {
+			removed = append(removed, role)
+		} else {
+			kept = append(kept, currPerms[i])
+		}
+	}
+	if len(removed) == 0 {
+		return removed
+	}
+	if len(kept) == 0 {
+		delete(cloudant, username)
+		forgetPluginMember(sec, username)
+	} else {
+		cloudant[username] = kept
+	}
+	return removed
+}
+
+/*
+*	Returns the roles of every username the document names. In the
+*	couchdb model these are "admin" and "member".
+ */
+func getGrantees(sec Security) map[string][]string {
+	grantees := make(map[string][]string)
+	if sec.Model == "couchdb" {
+		admins := getSecurityNames(sec, "admins")
+		for i := 0; i < len(admins); i++ {
+			grantees[admins[i]] = append(grantees[admins[i]], "admin")
+		}
+		members := getSecurityNames(sec, "members")
+		for i := 0; i < len(members); i++ {
+			grantees[members[i]] = append(grantees[members[i]], "member")
+		}
+		return grantees
+	}
+	cloudant, _ := sec.Parsed["cloudant"].(map[string]interface{})
+	for username, currPerms := range cloudant {
+		currRoles, _ := currPerms.([]interface{})
+		grantees[username] = []string{}
+		for i := 0; i < len(currRoles); i++ {
+			if role, ok := currRoles[i].(string); ok {
+				grantees[username] = append(grantees[username], role)
+			}
+		}
+	}
+	return grantees
+}
+
+/*
+*	Saves the document as it was read to the security snapshot and
+*	writes the changed document
+ */
+func putSecurity(sec Security, db string, httpClient *http.Client, account cam.CloudantAccount) bcr_utils.HttpResponse {
+	if err := saveSecuritySnapshot(account, db, sec.Model, sec.Body); err != nil {
+		return bcr_utils.HttpResponse{RequestType: "PUT", Err: err}
+	}
+	bd, _ := json.MarshalIndent(sec.Parsed, " ", "  ")
+	return putPermissions(string(bd), db, sec.Model, httpClient, account)
+}
+
+func getCloudantSection(sec Security) map[string]interface{} {
+	cloudant, _ := sec.Parsed["cloudant"].(map[string]interface{})
+	if cloudant == nil {
+		cloudant = make(map[string]interface{})
+		sec.Parsed["cloudant"] = cloudant
+	}
+	return cloudant
+}
+
+/*
+*	Returns the names listed in the admins or members section
+ */
+func getSecurityNames(sec Security, section string) []string {
+	var names []string
+	obj, _ := sec.Parsed[section].(map[string]interface{})
+	currNames, _ := obj["names"].([]interface{})
+	for i := 0; i < len(currNames); i++ {
+		if name, ok := currNames[i].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func setSecurityNames(sec Security, section string, names []string) {
+	obj, _ := sec.Parsed[section].(map[string]interface{})
+	if obj == nil {
+		obj = make(map[string]interface{})
+		sec.Parsed[section] = obj
+	}
+	obj["names"] = names
+	if obj["roles"] == nil {
+		obj["roles"] = []string{}
+	}
+}
+
+func removeSecurityName(sec Security, section string, name string) bool {
+	names := getSecurityNames(sec, section)
+	var kept []string
+	for i := 0; i < len(names); i++ {
+		if names[i] != name {
+			kept = append(kept, names[i])
+		}
+	}
+	if len(kept) == len(names) {
+		return false
+	}
+	if kept == nil {
+		kept = []string{}
+	}
+	setSecurityNames(sec, section, kept)
+	return true
+}
+
+/*
+*	Returns whether a couchdb _security document lets everyone access
+*	the database, which is the case while it has no members
+ */
+func isPublicDatabase(sec Security) bool {
+	obj, _ := sec.Parsed["members"].(map[string]interface{})
+	roles, _ := obj["roles"].([]interface{})
+	return len(getSecurityNames(sec, "members")) == 0 && len(roles) == 0
+}
+
+/*
+*	Returns the principals the plugin added to a _security document
+ */
+func getPluginMembers(sec Security) []string {
+	var names []string
+	currNames, _ := sec.Parsed[PLUGIN_MEMBERS_FIELD].([]interface{})
+	for i := 0; i < len(currNames); i++ {
+		if name, ok := currNames[i].(string); ok {
+			names = append(names, name)
+		}
+	}
+	if added, ok := sec.Parsed[PLUGIN_MEMBERS_FIELD].([]string); ok {
+		names = append(names, added...)
+	}
+	return names
+}
+
+func forgetPluginMember(sec Security, name string) bool {
+	names := getPluginMembers(sec)
+	var kept []string
+	for i := 0; i < len(names); i++ {
+		if names[i] != name {
+			kept = append(kept, names[i])
+		}
+	}
+	if len(kept) == len(names) {
+		return false
+	}
+	if len(kept) == 0 {
+		delete(sec.Parsed, PLUGIN_MEMBERS_FIELD)
+	} else {
+		sec.Parsed[PLUGIN_MEMBERS_FIELD] = kept
+	}
+	return true
+}
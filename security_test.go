@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAddGrants(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		body     string
+		username string
+		roles    []string
+		changed  bool
+		expected string
+	}{
+		{"empty document", "cloudant", `{}`, "acct-eu", []string{"_reader"}, true,
+			`{"bc_replicator_members":["acct-eu"],"cloudant":{"acct-eu":["_reader"]}}`},
+		{"adds missing roles only", "cloudant", `{"cloudant":{"acct-eu":["_reader"]}}`, "acct-eu", []string{"_reader", "_writer"}, true,
+			`{"cloudant":{"acct-eu":["_reader","_writer"]}}`},
+		{"already granted", "cloudant", `{"cloudant":{"acct-eu":["_reader","_writer"]}}`, "acct-eu", []string{"_writer"}, false,
+			`{"cloudant":{"acct-eu":["_reader","_writer"]}}`},
+		{"no roles", "cloudant", `{"cloudant":{}}`, "acct-eu", nil, false, `{"cloudant":{}}`},
+		{"keeps other fields", "cloudant", `{"couchdb_auth_only":false,"cloudant":{"nobody":[]}}`, "key-1", []string{"_reader", "_replicator"}, true,
+			`{"bc_replicator_members":["key-1"],"cloudant":{"key-1":["_reader","_replicator"],"nobody":[]},"couchdb_auth_only":false}`},
+		{"new member", "couchdb", `{"admins":{"names":["admin"],"roles":[]},"members":{"names":["app"],"roles":[]}}`, "acct-eu", []string{"_reader"}, true,
+			`{"admins":{"names":["admin"],"roles":[]},"bc_replicator_members":["acct-eu"],"members":{"names":["app","acct-eu"],"roles":[]}}`},
+		{"already a member", "couchdb", `{"members":{"names":["acct-eu"],"roles":[]}}`, "acct-eu", []string{"_reader"}, false,
+			`{"members":{"names":["acct-eu"],"roles":[]}}`},
+		{"public database", "couchdb", `{"admins":{"names":[],"roles":[]},"members":{"names":[],"roles":[]}}`, "acct-eu", []string{"_reader"}, false,
+			`{"admins":{"names":[],"roles":[]},"members":{"names":[],"roles":[]}}`},
+	}
+	for i := 0; i < len(tests); i++ {
+		sec := newSecurity(t, tests[i].model, tests[i].body)
+		if changed := addGrants(sec, tests[i].username, tests[i].roles); changed != tests[i].changed {
+			t.Fatalf("%s: expected changed to be %v", tests[i].name, tests[i].changed)
+		}
+		if body, _ := json.Marshal(sec.Parsed); string(body) != tests[i].expected {
+			t.Fatalf("%s: expected %s, got %s", tests[i].name, tests[i].expected, body)
+		}
+	}
+}
+
+func TestRemoveGrants(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		body     string
+		username string
+		keep     []string
+		removed  []string
+		expected string
+	}{
+		{"only the plugin's roles", "cloudant", `{"cloudant":{"acct-eu":["_admin","_reader","_writer"]}}`, "acct-eu", nil,
+			[]string{"_reader", "_writer"}, `{"cloudant":{"acct-eu":["_admin"]}}`},
+		{"keeps the roles asked for", "cloudant", `{"cloudant":{"acct-eu":["_reader","_writer"]}}`, "acct-eu", []string{"_reader"},
+			[]string{"_writer"}, `{"cloudant":{"acct-eu":["_reader"]}}`},
+		{"drops a username left without roles", "cloudant",
+			`{"bc_replicator_members":["acct-eu","key-1"],"cloudant":{"acct-eu":["_reader","_replicator"]}}`, "acct-eu", nil,
+			[]string{"_reader", "_replicator"}, `{"bc_replicator_members":["key-1"],"cloudant":{}}`},
+		{"unknown username", "cloudant", `{"cloudant":{"acct-eu":["_reader"]}}`, "acct-au", nil,
+			nil, `{"cloudant":{"acct-eu":["_reader"]}}`},
+		{"nothing to remove", "cloudant", `{"cloudant":{"acct-eu":["_admin"]}}`, "acct-eu", nil,
+			nil, `{"cloudant":{"acct-eu":["_admin"]}}`},
+		{"member the plugin added", "couchdb", `{"bc_replicator_members":["acct-eu"],"members":{"names":["acct-eu","app"],"roles":["team"]}}`,
+			"acct-eu", nil, []string{"member"}, `{"members":{"names":["app"],"roles":["team"]}}`},
+		{"member still needed", "couchdb", `{"bc_replicator_members":["acct-eu"],"members":{"names":["acct-eu"],"roles":[]}}`,
+			"acct-eu", []string{"_reader"}, nil, `{"bc_replicator_members":["acct-eu"],"members":{"names":["acct-eu"],"roles":[]}}`},
+		{"member added by hand", "couchdb", `{"admins":{"names":["acct-eu"],"roles":[]},"members":{"names":["acct-eu"],"roles":[]}}`,
+			"acct-eu", nil, nil, `{"admins":{"names":["acct-eu"],"roles":[]},"members":{"names":["acct-eu"],"roles":[]}}`},
+	}
+	for i := 0; i < len(tests); i++ {
+		sec := newSecurity(t, tests[i].model, tests[i].body)
+		if removed := removeGrants(sec, tests[i].username, tests[i].keep); !reflect.DeepEqual(removed, tests[i].removed) {
+			t.Fatalf("%s: expected %v to be removed, got %v", tests[i].name, tests[i].removed, removed)
+		}
+		if body, _ := json.Marshal(sec.Parsed); string(body) != tests[i].expected {
+			t.Fatalf("%s: expected %s, got %s", tests[i].name, tests[i].expected, body)
+		}
+	}
+}
+
+func TestIsPublicDatabase(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected bool
+	}{
+		{`{}`, true},
+		{`{"admins":{"names":["admin"],"roles":["_admin"]}}`, true},
+		{`{"members":{"names":[],"roles":[]}}`, true},
+		{`{"members":{"names":["app"],"roles":[]}}`, false},
+		{`{"members":{"names":[],"roles":["team"]}}`, false},
+	}
+	for i := 0; i < len(tests); i++ {
+		if public := isPublicDatabase(newSecurity(t, "couchdb", tests[i].body)); public != tests[i].expected {
+			t.Fatalf("%s: expected public to be %v", tests[i].body, tests[i].expected)
+		}
+	}
+}
+
+func TestGetGrantees(t *testing.T) {
+	tests := []struct {
+		model    string
+		body     string
+		expected map[string][]string
+	}{
+		{"cloudant", `{"cloudant":{"acct-eu":["_reader","_writer"],"nobody":[]}}`,
+			map[string][]string{"acct-eu": {"_reader", "_writer"}, "nobody": {}}},
+		{"couchdb", `{"admins":{"names":["admin"],"roles":[]},"members":{"names":["admin","app"],"roles":[]}}`,
+			map[string][]string{"admin": {"admin", "member"}, "app": {"member"}}},
+	}
+	for i := 0; i < len(tests); i++ {
+		if grantees := getGrantees(newSecurity(t, tests[i].model, tests[i].body)); !reflect.DeepEqual(grantees, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].body, tests[i].expected, grantees)
+		}
+	}
+}
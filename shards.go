@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+/*
+*	Document IDs are sliced on their first character. Cloudant
+*	generates hexadecimal IDs, so the slices are cut between
+*	hexadecimal digits.
+ */
+var SHARD_BOUNDARIES = "0123456789abcdef"
+
+/*
+*	Returns the size of db in bytes, or 0 if it can't be read
+ */
+func getDatabaseSize(httpClient *http.Client, account cam.CloudantAccount, db string) int64 {
+	url := "https://" + account.Username + ".cloudant.com/" + db
+	headers := map[string]string{"Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", url, "", headers)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	var info struct {
+		DiskSize int64 `json:"disk_size"`
+		Sizes    struct {
+			External int64 `json:"external"`
+		} `json:"sizes"`
+	}
+	json.Unmarshal(respBody, &info)
+	if info.Sizes.External > 0 {
+		return info.Sizes.External
+	}
+	return info.DiskSize
+}
+
+/*
+*	Splits a replication document into shards documents. Each one
+*	only replicates the document IDs in its slice, and together the
+*	slices cover every ID. The first slice holds everything sorting
+*	before the first boundary and the last everything after the last.
+ */
+func shardReplicationDocument(rep map[string]interface{}, shards int) []map[string]interface{} {
+	var reps []map[string]interface{}
+	for i := 0; i < shards; i++ {
+		idRange := make(map[string]interface{})
+		if i > 0 {
+			idRange["$gte"] = string(SHARD_BOUNDARIES[i*len(SHARD_BOUNDARIES)/shards])
+		}
+		if i < shards-1 {
+			idRange["$lt"] = string(SHARD_BOUNDARIES[(i+1)*len(SHARD_BOUNDARIES)/shards])
+		}
+		shard := make(map[string]interface{})
+		for field, value := range rep {
+			shard[field] = value
+		}
+		shard["_id"] = rep["_id"].(string) + "-shard-" + strconv.Itoa(i+1) + "-of-" + strconv.Itoa(shards)
+		addSelector(shard, map[string]interface{}{"_id": idRange})
+		reps = append(reps, shard)
+	}
+	return reps
+}
+
+/*
+*	Restricts a replication document to the documents matching
+*	selector, on top of any selector it already has
+ */
+func addSelector(rep map[string]interface{}, selector map[string]interface{}) {
+	if rep["selector"] == nil {
+		rep["selector"] = selector
+	} else {
+		rep["selector"] = map[string]interface{}{"$and": []interface{}{rep["selector"], selector}}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/cloudfoundry/cli/plugin"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/cloudantAccounts"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*	The permissions of one database as they were before the plugin
+*	changed them. Security holds the _security body exactly as it was
+*	read.
+ */
+type SecuritySnapshotEntry struct {
+	Endpoint string          `json:"endpoint"`
+	Username string          `json:"username"`
+	Db       string          `json:"db"`
+	Model    string          `json:"model"`
+	Time     string          `json:"time"`
+	Security json.RawMessage `json:"security"`
+}
+
+/*
+*	The snapshot file of this run, created when the first _security
+*	document is about to change
+ */
+var SNAPSHOT_FILE = ""
+
+var snapshotMutex sync.Mutex
+
+/*
+*	Appends the permissions of db in account to the snapshot file of
+*	this run. Permissions must not be changed when this fails.
+ */
+func saveSecuritySnapshot(account cam.CloudantAccount, db string, model string, perms string) error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if SNAPSHOT_FILE == "" {
+		SNAPSHOT_FILE = "security-snapshot-" + time.Now().Format("20060102-150405") + ".jsonl"
+	}
+	return appendSecurityEntry(SNAPSHOT_FILE, account, db, model, perms)
+}
+
+/*
+*	Appends the permissions of db in account to file
+ */
+func appendSecurityEntry(file string, account cam.CloudantAccount, db string, model string, perms string) error {
+	if strings.TrimSpace(perms) == "" {
+		perms = "{}"
+	}
+	entry := SecuritySnapshotEntry{Endpoint: account.Endpoint, Username: account.Username, Db: db, Model: model,
+		Time: time.Now().UTC().Format(time.RFC3339), Security: json.RawMessage(perms)}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.New("The permissions of '" + terminal.ColorizeBold(db, 36) + "' in '" +
+			terminal.ColorizeBold(account.Endpoint, 36) + "' are not valid JSON and were not changed")
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return errors.New("Unable to write '" + terminal.ColorizeBold(file, 36) + "', the permissions of '" +
+			terminal.ColorizeBold(db, 36) + "' in '" + terminal.ColorizeBold(account.Endpoint, 36) + "' were not changed")
+	}
+	return nil
+}
+
+/*
+*	Tells the user where the original permissions were saved
+ */
+func printSecuritySnapshot() {
+	if SNAPSHOT_FILE != "" {
+		fmt.Println("\nThe original database permissions were saved to '" + terminal.ColorizeBold(SNAPSHOT_FILE, 36) +
+			"'. Restore them with '" + terminal.ColorizeBold("cf cloudant-restore-security "+SNAPSHOT_FILE, 33) + "'")
+	}
+}
+
+/*
+*	Reads a snapshot file. When a database appears more than once the
+*	first entry is kept, since it holds the permissions from before
+*	the run.
+ */
+func readSecuritySnapshot(file string) ([]SecuritySnapshotEntry, error) {
+	var entries []SecuritySnapshotEntry
+	f, err := os.Open(file)
+	if err != nil {
+		return entries, errors.New("Unable to open security snapshot '" + terminal.ColorizeBold(file, 36) + "'")
+	}
+	defer f.Close()
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry SecuritySnapshotEntry
+		if json.Unmarshal([]byte(line), &entry) != nil || entry.Username == "" || entry.Db == "" {
+			return entries, errors.New("Invalid entry on line " + strconv.Itoa(lineNum) + " of '" + file + "'")
+		}
+		if seen[entry.Username+"/"+entry.Db] {
+			continue
+		}
+		seen[entry.Username+"/"+entry.Db] = true
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+/*
+*	Puts the permissions saved in a snapshot file back in every
+*	region. The current permissions are saved to a new snapshot first,
+*	so a restore can be undone the same way.
+ */
+func restoreSecurity(cliConnection plugin.CliConnection, args []string) {
+	flags := bcr_utils.HandleFlags(args)
+	if len(flags.Args) != 1 {
+		bcr_utils.CheckErrorFatal(errors.New("Please pass the snapshot file to restore. For help look to '" +
+			terminal.ColorizeBold("cf help cloudant-restore-security", 33) + "'"))
+	}
+	entries, err := readSecuritySnapshot(flags.Args[0])
+	bcr_utils.CheckErrorFatal(err)
+	appname, password := getAppAndPassword(cliConnection, flags)
+	startingEndpoint, username, startingOrg, startingSpace := bcr_utils.GetCurrentTarget(cliConnection)
+	defer finalLogin(cliConnection, startingEndpoint, username, password, startingOrg, startingSpace)
+	var httpClient = &http.Client{}
+	cloudantAccounts, err := ca.GetCloudantAccounts(cliConnection, httpClient, ENDPOINTS, appname, password)
+	bcr_utils.CheckErrorFatal(err)
+	restored, skipped := restoreSecurityEntries(httpClient, cloudantAccounts, entries)
+	deleteCookies(httpClient, cloudantAccounts)
+	fmt.Println(terminal.ColorizeBold("\nSUMMARY", 35))
+	fmt.Println("\nRestored the permissions from '" + terminal.ColorizeBold(flags.Args[0], 36) + "' of:\n")
+	for i := 0; i < len(restored); i++ {
+		fmt.Println(restored[i])
+	}
+	if len(skipped) > 0 {
+		fmt.Println("\nSkipped, no Cloudant service of '" + terminal.ColorizeBold(appname, 36) + "' was found for the account:\n")
+		for i := 0; i < len(skipped); i++ {
+			fmt.Println(skipped[i])
+		}
+	}
+	printSecuritySnapshot()
+}
+
+/*
+*	Puts back the permissions of each entry. The permissions they
+*	replace are saved to the snapshot of this run first. Returns the
+*	restored entries and the ones skipped because their account isn't
+*	one of cloudantAccounts.
+ */
+func restoreSecurityEntries(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, entries []SecuritySnapshotEntry) ([]string, []string) {
+	fmt.Println("\nRestoring database permissions\n")
+	var restored, skipped []string
+	responses := make(chan bcr_utils.HttpResponse)
+	restored_ch := make(chan string)
+	numRequests := 0
+	for i := 0; i < len(entries); i++ {
+		line := terminal.ColorizeBold(entries[i].Db, 36) + " in " + entries[i].Endpoint
+		account, found := findAccountByUsername(entries[i].Username, cloudantAccounts)
+		if !found {
+			skipped = append(skipped, line)
+			continue
+		}
+		numRequests += 1
+		go func(httpClient *http.Client, account cam.CloudantAccount, entry SecuritySnapshotEntry, line string) {
+			sec, r := getSecurity(entry.Db, httpClient, account)
+			split_status := strings.Split(r.Status, " ")[0]
+			status, _ := strconv.Atoi(split_status)
+			if status != 200 || r.Err != nil {
+				r.Err = errors.New("Unable to read the permissions of '" + terminal.ColorizeBold(entry.Db, 36) + "' in '" +
+					terminal.ColorizeBold(account.Endpoint, 36) + "'")
+				responses <- r
+				restored_ch <- ""
+				return
+			}
+			if err := saveSecuritySnapshot(account, entry.Db, sec.Model, sec.Body); err != nil {
+				responses <- bcr_utils.HttpResponse{RequestType: "PUT", Err: err}
+				restored_ch <- ""
+				return
+			}
+			r = putPermissions(string(entry.Security), entry.Db, entry.Model, httpClient, account)
+			responses <- r
+			if r.Err == nil {
+				restored_ch <- line
+			} else {
+				restored_ch <- ""
+			}
+		}(httpClient, account, entries[i], line)
+	}
+	bcr_utils.CheckHttpResponses(responses, numRequests)
+	close(responses)
+	for i := 0; i < numRequests; i++ {
+		if line := <-restored_ch; line != "" {
+			restored = append(restored, line)
+		}
+	}
+	close(restored_ch)
+	return restored, skipped
+}
+
+/*
+*	Writes perms as the _security document of db in the given model
+ */
+func putPermissions(perms string, db string, model string, httpClient *http.Client, account cam.CloudantAccount) bcr_utils.HttpResponse {
+	headers := map[string]string{"Content-Type": "application/json", "Cookie": account.Cookie}
+	resp, err := bcr_utils.MakeRequest(httpClient, "PUT", getSecurityUrl(account, db, model), perms, headers)
+	if err != nil {
+		return bcr_utils.HttpResponse{RequestType: "PUT", Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 && status != 201 {
+		err = errors.New("Unable to write the permissions of '" + terminal.ColorizeBold(db, 36) + "' in '" +
+			terminal.ColorizeBold(account.Endpoint, 36) + "'")
+	}
+	return bcr_utils.HttpResponse{RequestType: "PUT", Status: resp.Status, Body: string(respBody), Err: err}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var POLL_INTERVAL = 5 * time.Second
+
+/*
+*	The final state of a one-shot replication of a single database
+ */
+type ReplicationResult struct {
+	Source           string
+	Target           string
+	Db               string
+	State            string
+	Reason           string
+	DocsWritten      int
+	DocWriteFailures int
+	Shards           int
+	Document         string
+	Local            bool
+}
+
+/*
+*	Polls the replication documents of one logical replication until
+*	each has finished, failed or was given up and
+*	returns the combined statistics. There is more than one document
+*	when the replication was split into shards.
+ */
+func waitForReplication(httpClient *http.Client, owner cam.CloudantAccount, replicatorDb string, docIds []string, replication Replication, db string) ReplicationResult {
+	result := ReplicationResult{Source: replication.Source.Endpoint, Target: replication.Target.Endpoint, Db: db,
+		State: "completed", Shards: len(docIds)}
+	var reasons []string
+	for i := 0; i < len(docIds); i++ {
+		state, reason, docsWritten, docWriteFailures := waitForReplicationDocument(httpClient, owner, replicatorDb, docIds[i])
+		if state != "completed" {
+			result.State = state
+		}
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+		result.DocsWritten += docsWritten
+		result.DocWriteFailures += docWriteFailures
+	}
+	result.Reason = strings.Join(reasons, "; ")
+	fmt.Println("Replication of '" + terminal.ColorizeBold(db, 36) + "' from '" +
+		terminal.ColorizeBold(replication.Source.Endpoint, 36) + "' to '" +
+		terminal.ColorizeBold(replication.Target.Endpoint, 36) + "' finished with state '" + result.State + "'")
+	return result
+}
+
+/*
+*	How long a one-shot replication may take, how long it may keep
+*	crashing and how many polls in a row may fail before waiting for
+*	it is given up
+ */
+var REPLICATION_TIMEOUT = 12 * time.Hour
+var CRASHING_TIMEOUT = 2 * time.Minute
+var MAX_POLL_FAILURES = 5
+
+/*
+*	The state of a replication as reported by the scheduler or by its
+*	replication document
+ */
+type replicationState struct {
+	State            string
+	Reason           string
+	DocsWritten      int
+	DocWriteFailures int
+}
+
+/*
+*	Polls a single replication until it reaches "completed", "failed"
+*	or "error". The state is read from the replication scheduler, and
+*	from the replication document when the scheduler doesn't know the
+*	job. A job that keeps crashing, e.g. because its credentials are
+*	rejected, is given up after CRASHING_TIMEOUT and any job after
+*	REPLICATION_TIMEOUT.
+ */
+func waitForReplicationDocument(httpClient *http.Client, owner cam.CloudantAccount, replicatorDb string, docId string) (string, string, int, int) {
+	docUrl := "https://" + owner.Username + ".cloudant.com/" + url.PathEscape(replicatorDb) + "/" + url.PathEscape(docId)
+	schedulerUrl := "https://" + owner.Username + ".cloudant.com/_scheduler/docs/" + url.PathEscape(replicatorDb) + "/" + url.PathEscape(docId)
+	headers := map[string]string{"Cookie": owner.Cookie}
+	deadline := time.Now().Add(REPLICATION_TIMEOUT)
+	var crashingSince time.Time
+	failures := 0
+	for {
+		state, status, err := getReplicationState(httpClient, schedulerUrl, headers, true)
+		if err != nil || status != 200 {
+			state, status, err = getReplicationState(httpClient, docUrl, headers, false)
+		}
+		if err == nil && status == 404 {
+			return "error", "the replication document was deleted", 0, 0
+		}
+		if err != nil || status != 200 {
+			failures += 1
+			if failures >= MAX_POLL_FAILURES {
+				reason := "the replication document could not be read"
+				if err != nil {
+					reason = err.Error()
+				}
+				return "error", reason, 0, 0
+			}
+		} else {
+			failures = 0
+			if state.State == "completed" || state.State == "failed" || state.State == "error" {
+				return state.State, state.Reason, state.DocsWritten, state.DocWriteFailures
+			}
+			if state.State != "crashing" {
+				crashingSince = time.Time{}
+			} else if crashingSince.IsZero() {
+				crashingSince = time.Now()
+			} else if time.Since(crashingSince) > CRASHING_TIMEOUT {
+				return "crashing", state.Reason, state.DocsWritten, state.DocWriteFailures
+			}
+		}
+		if time.Now().After(deadline) {
+			return "timeout", "not finished after " + REPLICATION_TIMEOUT.String(), state.DocsWritten, state.DocWriteFailures
+		}
+		time.Sleep(POLL_INTERVAL)
+	}
+}
+
+/*
+*	Reads the state of a replication from the scheduler's entry for
+*	it, or from its replication document
+ */
+func getReplicationState(httpClient *http.Client, stateUrl string, headers map[string]string, scheduler bool) (replicationState, int, error) {
+	state := replicationState{}
+	resp, err := bcr_utils.MakeRequest(httpClient, "GET", stateUrl, "", headers)
+	if err != nil {
+		return state, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	split_status := strings.Split(resp.Status, " ")[0]
+	status, _ := strconv.Atoi(split_status)
+	if status != 200 {
+		return state, status, nil
+	}
+	if scheduler {
+		var job struct {
+			State string                 `json:"state"`
+			Info  map[string]interface{} `json:"info"`
+		}
+		json.Unmarshal(respBody, &job)
+		state.State = job.State
+		state.Reason, _ = job.Info["error"].(string)
+		docsWritten, _ := job.Info["docs_written"].(float64)
+		docWriteFailures, _ := job.Info["doc_write_failures"].(float64)
+		state.DocsWritten, state.DocWriteFailures = int(docsWritten), int(docWriteFailures)
+		return state, status, nil
+	}
+	var doc struct {
+		State  string `json:"_replication_state"`
+		Reason string `json:"_replication_state_reason"`
+		Stats  struct {
+			DocsWritten      int `json:"docs_written"`
+			DocWriteFailures int `json:"doc_write_failures"`
+		} `json:"_replication_stats"`
+	}
+	json.Unmarshal(respBody, &doc)
+	state = replicationState{State: doc.State, Reason: doc.Reason, DocsWritten: doc.Stats.DocsWritten,
+		DocWriteFailures: doc.Stats.DocWriteFailures}
+	return state, status, nil
+}
+
+/*
+*	Prints the outcome of every one-shot replication
+ */
+func printReplicationResults(results []ReplicationResult) {
+	fmt.Println("\nOne-shot replications:\n")
+	for i := 0; i < len(results); i++ {
+		r := results[i]
+		line := terminal.ColorizeBold(r.Db, 36) + ": " + r.Source + " -> " + r.Target + " " +
+			strconv.Itoa(r.DocsWritten) + " docs written, " + strconv.Itoa(r.DocWriteFailures) + " failures"
+		if r.Shards > 1 {
+			line += " in " + strconv.Itoa(r.Shards) + " shards"
+		}
+		if r.State == "completed" {
+			fmt.Println(line)
+		} else {
+			fmt.Println(line + " " + terminal.ColorizeBold(r.State, 31) + " " + r.Reason)
+		}
+	}
+}
+
+/*
+*	Prints the replications the plugin copied once itself in place of
+*	continuous replications, which are not kept in sync without
+*	--foreground
+ */
+func printLocalResults(results []ReplicationResult) {
+	var local []ReplicationResult
+	for i := 0; i < len(results); i++ {
+		if results[i].Local {
+			local = append(local, results[i])
+		}
+	}
+	if len(local) == 0 {
+		return
+	}
+	fmt.Println("\nReplications Cloudant can't run were copied once by the plugin and are " + terminal.ColorizeBold("not", 33) +
+		" kept in sync. Run the command again to copy new changes, or pass '" + terminal.ColorizeBold("--foreground", 33) +
+		"' to keep them running for as long as the plugin runs:\n")
+	for i := 0; i < len(local); i++ {
+		r := local[i]
+		line := terminal.ColorizeBold(r.Db, 36) + ": " + r.Source + " -> " + r.Target + " " +
+			strconv.Itoa(r.DocsWritten) + " docs written, " + strconv.Itoa(r.DocWriteFailures) + " failures"
+		if r.State == "completed" {
+			fmt.Println(line)
+		} else {
+			fmt.Println(line + " " + terminal.ColorizeBold(r.State, 31) + " " + r.Reason)
+		}
+	}
+}
+
+/*
+*	Prints the continuous replications that were split into shards
+ */
+func printShardedReplications(results []ReplicationResult) {
+	var sharded []ReplicationResult
+	for i := 0; i < len(results); i++ {
+		if results[i].Shards > 1 {
+			sharded = append(sharded, results[i])
+		}
+	}
+	if len(sharded) == 0 {
+		return
+	}
+	fmt.Println("\nSharded replications:\n")
+	for i := 0; i < len(sharded); i++ {
+		r := sharded[i]
+		fmt.Println(terminal.ColorizeBold(r.Db, 36) + ": " + r.Source + " -> " + r.Target + " in " +
+			strconv.Itoa(r.Shards) + " shards")
+	}
+}
+
+/*
+*	Prints the continuous replications whose documents already
+*	existed, and whether they had to be replaced to match the options
+*	of this run
+ */
+func printDocumentOutcomes(results []ReplicationResult) {
+	var updated, unchanged []string
+	for i := 0; i < len(results); i++ {
+		r := results[i]
+		line := terminal.ColorizeBold(r.Db, 36) + ": " + r.Source + " -> " + r.Target
+		if r.Document == "updated" {
+			updated = append(updated, line)
+		} else if r.Document == "unchanged" {
+			unchanged = append(unchanged, line)
+		}
+	}
+	if len(updated) > 0 {
+		fmt.Println("\nReplication documents replaced to match the options of this run:\n")
+		for i := 0; i < len(updated); i++ {
+			fmt.Println(updated[i])
+		}
+	}
+	if len(unchanged) > 0 {
+		fmt.Println("\nReplication documents that already existed with the same options and were not updated:\n")
+		for i := 0; i < len(unchanged); i++ {
+			fmt.Println(unchanged[i])
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+*	The CouchDB replication options that can be passed with
+*	--rep-options
+ */
+var REPLICATION_OPTIONS = []string{"worker_processes",
+	"worker_batch_size",
+	"http_connections",
+	"connection_timeout",
+	"retries_per_request",
+	"checkpoint_interval",
+	"use_checkpoints",
+	"since_seq"}
+
+/*
+*	Fields generated by the plugin that a template may not override.
+*	continuous is set by --once, and a continuous document would never
+*	complete while the plugin waits for it.
+ */
+var RESERVED_FIELDS = []string{"_id", "source", "target", "continuous", "create_target"}
+
+/*
+*	Extra fields added to every generated replication document.
+*	Fields holds the fields for all databases and Databases the
+*	fields for a single database, which take precedence.
+ */
+type ReplicationTemplate struct {
+	Fields    map[string]interface{}            `json:"fields"`
+	Databases map[string]map[string]interface{} `json:"databases"`
+}
+
+/*
+*	Builds the replication template from the file passed with
+*	--rep-template and the options passed with --rep-options. A
+*	template file has the form
+*
+*		{
+*			"fields": {"worker_processes": 4},
+*			"databases": {"orders": {"checkpoint_interval": 5000}}
+*		}
+*
+*	Options are given as KEY=VALUE, or DATABASE:KEY=VALUE for a single
+*	database, and override the fields of the file. So do the
+*	filter, query_params, selector and doc_ids passed as flags.
+ */
+func getReplicationTemplate(flags bcr_utils.Flags) (ReplicationTemplate, error) {
+	template := ReplicationTemplate{}
+	if flags.RepTemplate != "" {
+		file, err := ioutil.ReadFile(flags.RepTemplate)
+		if err != nil {
+			return template, errors.New("Unable to read replication template '" + terminal.ColorizeBold(flags.RepTemplate, 36) + "'")
+		}
+		err = json.Unmarshal(file, &template)
+		if err != nil {
+			return template, errors.New("Replication template '" + terminal.ColorizeBold(flags.RepTemplate, 36) +
+				"' is not valid JSON: " + err.Error())
+		}
+	}
+	if template.Fields == nil {
+		template.Fields = make(map[string]interface{})
+	}
+	if template.Databases == nil {
+		template.Databases = make(map[string]map[string]interface{})
+	}
+	for i := 0; i < len(flags.RepOptions); i++ {
+		split_opt := strings.SplitN(flags.RepOptions[i], "=", 2)
+		if len(split_opt) != 2 {
+			return template, errors.New("Invalid replication option '" + flags.RepOptions[i] + "'. Use KEY=VALUE or DATABASE:KEY=VALUE")
+		}
+		db, key := "", split_opt[0]
+		if strings.Contains(key, ":") {
+			split_key := strings.SplitN(key, ":", 2)
+			db, key = split_key[0], split_key[1]
+		}
+		if !bcr_utils.IsValid(key, REPLICATION_OPTIONS) {
+			return template, errors.New("Unknown replication option '" + key + "'. Supported options are " +
+				strings.Join(REPLICATION_OPTIONS, ", "))
+		}
+		var value interface{}
+		if json.Unmarshal([]byte(split_opt[1]), &value) != nil {
+			value = split_opt[1]
+		}
+		if db == "" {
+			template.Fields[key] = value
+		} else {
+			if template.Databases[db] == nil {
+				template.Databases[db] = make(map[string]interface{})
+			}
+			template.Databases[db][key] = value
+		}
+	}
+	if flags.Filter != "" {
+		template.Fields["filter"] = flags.Filter
+	}
+	if len(flags.QueryParams) > 0 {
+		queryParams := make(map[string]interface{})
+		for i := 0; i < len(flags.QueryParams); i++ {
+			split_param := strings.SplitN(flags.QueryParams[i], "=", 2)
+			if len(split_param) != 2 {
+				return template, errors.New("Invalid query parameter '" + flags.QueryParams[i] + "'. Use KEY=VALUE")
+			}
+			queryParams[split_param[0]] = split_param[1]
+		}
+		template.Fields["query_params"] = queryParams
+	}
+	if flags.Selector != "" {
+		var selector map[string]interface{}
+		if json.Unmarshal([]byte(flags.Selector), &selector) != nil {
+			return template, errors.New("The selector '" + flags.Selector + "' is not a valid JSON object")
+		}
+		template.Fields["selector"] = selector
+	}
+	if len(flags.DocIds) > 0 {
+		var docIds []interface{}
+		for i := 0; i < len(flags.DocIds); i++ {
+			docIds = append(docIds, flags.DocIds[i])
+		}
+		template.Fields["doc_ids"] = docIds
+	}
+	for field := range template.Fields {
+		if bcr_utils.IsValid(field, RESERVED_FIELDS) {
+			return template, errors.New("The replication template may not set '" + field + "'")
+		}
+	}
+	for _, fields := range template.Databases {
+		for field := range fields {
+			if bcr_utils.IsValid(field, RESERVED_FIELDS) {
+				return template, errors.New("The replication template may not set '" + field + "'")
+			}
+		}
+	}
+	return template, nil
+}
+
+/*
+*	Adds the template fields for db to the replication document rep.
+*	The placeholders {{db}}, {{source}} and {{target}} in string
+*	values are replaced with the database name and the regions of
+*	the replication.
+ */
+func applyReplicationTemplate(rep map[string]interface{}, template ReplicationTemplate, db string, replication Replication) {
+	replacer := strings.NewReplacer("{{db}}", db,
+		"{{source}}", bcr_utils.GetRegion(replication.Source.Endpoint),
+		"{{target}}", bcr_utils.GetRegion(replication.Target.Endpoint))
+	for field, value := range template.Fields {
+		rep[field] = expandTemplateValue(value, replacer)
+	}
+	for field, value := range template.Databases[db] {
+		rep[field] = expandTemplateValue(value, replacer)
+	}
+}
+
+func expandTemplateValue(value interface{}, replacer *strings.Replacer) interface{} {
+	switch v := value.(type) {
+	case string:
+		return replacer.Replace(v)
+	case map[string]interface{}:
+		expanded := make(map[string]interface{})
+		for key, el := range v {
+			expanded[key] = expandTemplateValue(el, replacer)
+		}
+		return expanded
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i := 0; i < len(v); i++ {
+			expanded[i] = expandTemplateValue(v[i], replacer)
+		}
+		return expanded
+	}
+	return value
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cloudfoundry/cli/cf/terminal"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+*	A single one-way replication between two accounts. If Dbs is
+*	empty the replication applies to every selected database. Key is
+*	the API key the replication uses, if one was generated for it.
+ */
+type Replication struct {
+	Source cam.CloudantAccount
+	Target cam.CloudantAccount
+	Dbs    []string
+	Key    ApiKey
+}
+
+/*
+*	One line of an edge-list file, before its regions are resolved
+ */
+type Edge struct {
+	Source string
+	Target string
+	Dbs    []string
+}
+
+/*
+*	Builds the list of replications for the selected topology.
+*	"mesh" links every account with every other account, "hub" only
+*	links each spoke to and from the hub and "primary" only
+*	replicates from the primary to each of the replicas. "edges"
+*	creates exactly the replications listed in an edge-list file.
+ */
+func getReplications(flags bcr_utils.Flags, cloudantAccounts []cam.CloudantAccount) ([]Replication, error) {
+	var replications []Replication
+	switch flags.Topology {
+	case "hub":
+		hub, found := bcr_utils.FindAccount(flags.Hub, cloudantAccounts)
+		if !found {
+			return replications, errors.New("No Cloudant service was found for hub region '" +
+				terminal.ColorizeBold(flags.Hub, 36) + "'")
+		}
+		for i := 0; i < len(cloudantAccounts); i++ {
+			if cloudantAccounts[i].Username != hub.Username {
+				replications = append(replications, Replication{Source: hub, Target: cloudantAccounts[i]})
+				replications = append(replications, Replication{Source: cloudantAccounts[i], Target: hub})
+			}
+		}
+	case "primary":
+		primary, found := bcr_utils.FindAccount(flags.Primary, cloudantAccounts)
+		if !found {
+			return replications, errors.New("No Cloudant service was found for primary region '" +
+				terminal.ColorizeBold(flags.Primary, 36) + "'")
+		}
+		for i := 0; i < len(cloudantAccounts); i++ {
+			if cloudantAccounts[i].Username != primary.Username {
+				replications = append(replications, Replication{Source: primary, Target: cloudantAccounts[i]})
+			}
+		}
+	case "edges":
+		edges, err := readEdges(flags.Edges)
+		if err != nil {
+			return replications, err
+		}
+		return resolveEdges(edges, cloudantAccounts)
+	default:
+		for i := 0; i < len(cloudantAccounts); i++ {
+			for j := 0; j < len(cloudantAccounts); j++ {
+				if i != j {
+					replications = append(replications, Replication{Source: cloudantAccounts[i], Target: cloudantAccounts[j]})
+				}
+			}
+		}
+	}
+	return replications, nil
+}
+
+/*
+*	Returns the account whose _replicator database holds the document
+*	for replication. With "pull" placement the target does the work,
+*	with "push" placement the source does.
+ */
+func getReplicationOwner(replication Replication, placement string) cam.CloudantAccount {
+	if placement == "push" {
+		return replication.Source
+	}
+	return replication.Target
+}
+
+/*
+*	Returns the _id of the replication document for db. The id only
+*	has to be unique within the owner's _replicator database.
+ */
+func getReplicationDocId(replication Replication, db string, placement string) string {
+	if placement == "push" {
+		return db + "-" + replication.Target.Username
+	}
+	return replication.Source.Username + "-" + db
+}
+
+/*
+*	The roles the plugin grants on replicated databases
+ */
+var GRANTED_ROLES = []string{"_reader", "_writer", "_replicator"}
+
+/*
+*	Returns the roles that have to be granted on one of account's
+*	databases, keyed by the username of the account receiving them.
+*	With "pull" placement every account replicating from account
+*	needs to read from it. With "push" placement every account
+*	replicating into account needs to write to it, and to read the
+*	revisions it already has. A replication with an API key only
+*	needs its key granted, to read from the source and to write to
+*	the target. On the source the key also needs _replicator, as the
+*	replication writes its checkpoints there.
+ */
+func getGrants(account cam.CloudantAccount, replications []Replication, placement string) map[string][]string {
+	grants := make(map[string][]string)
+	for i := 0; i < len(replications); i++ {
+		if replications[i].Key.Key != "" {
+			if replications[i].Source.Username == account.Username {
+				grants[replications[i].Key.Key] = []string{"_reader", "_replicator"}
+			} else if replications[i].Target.Username == account.Username {
+				grants[replications[i].Key.Key] = []string{"_reader", "_writer"}
+			}
+		} else if placement == "push" && replications[i].Target.Username == account.Username {
+			grants[replications[i].Source.Username] = []string{"_reader", "_writer"}
+		} else if placement != "push" && replications[i].Source.Username == account.Username {
+			grants[replications[i].Target.Username] = []string{"_reader"}
+		}
+	}
+	return grants
+}
+
+/*
+*	Returns the replications that apply to db. Only replications
+*	between the accounts db lives in are kept.
+ */
+func replicationsForDatabase(db string, replications []Replication, dbAccounts []cam.CloudantAccount) []Replication {
+	var dbReplications []Replication
+	for i := 0; i < len(replications); i++ {
+		_, sourceFound := bcr_utils.FindAccount(replications[i].Source.Endpoint, dbAccounts)
+		_, targetFound := bcr_utils.FindAccount(replications[i].Target.Endpoint, dbAccounts)
+		if sourceFound && targetFound && (len(replications[i].Dbs) == 0 || bcr_utils.IsValid(db, replications[i].Dbs)) {
+			dbReplications = append(dbReplications, replications[i])
+		}
+	}
+	return dbReplications
+}
+
+/*
+*	Returns the accounts db should live in. Databases missing from
+*	dbRegions live in every account.
+ */
+func accountsForDatabase(db string, dbRegions map[string][]string, cloudantAccounts []cam.CloudantAccount) []cam.CloudantAccount {
+	regions, found := dbRegions[db]
+	if !found {
+		return cloudantAccounts
+	}
+	var dbAccounts []cam.CloudantAccount
+	for i := 0; i < len(regions); i++ {
+		account, found := bcr_utils.FindAccount(regions[i], cloudantAccounts)
+		if found {
+			dbAccounts = append(dbAccounts, account)
+		} else {
+			fmt.Println(terminal.ColorizeBold("WARNING", 33) + ": no Cloudant service was found for region '" +
+				terminal.ColorizeBold(regions[i], 36) + "' of '" + terminal.ColorizeBold(db, 36) + "'\n")
+		}
+	}
+	return dbAccounts
+}
+
+/*
+*	Reads a file mapping databases to the regions they live in. Each
+*	line holds one database in the form
+*
+*		DATABASE = REGION,REGION,...
+*
+*	Blank lines and lines starting with '#' are ignored. Databases
+*	already present in dbRegions are left untouched.
+ */
+func readDatabaseRegions(file string, dbRegions map[string][]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.New("Unable to open database region file '" + terminal.ColorizeBold(file, 36) + "'")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split_line := strings.SplitN(line, "=", 2)
+		if len(split_line) != 2 || strings.TrimSpace(split_line[0]) == "" || strings.TrimSpace(split_line[1]) == "" {
+			return errors.New("Invalid entry on line " + strconv.Itoa(lineNum) + " of '" + file + "': " + line)
+		}
+		db := strings.TrimSpace(split_line[0])
+		if _, found := dbRegions[db]; found {
+			continue
+		}
+		var regions []string
+		split_regions := strings.Split(split_line[1], ",")
+		for i := 0; i < len(split_regions); i++ {
+			regions = append(regions, strings.TrimSpace(split_regions[i]))
+		}
+		dbRegions[db] = regions
+	}
+	return scanner.Err()
+}
+
+/*
+*	Reads an edge-list file. Each line holds one edge in the form
+*
+*		SOURCE -> TARGET [DATABASE,DATABASE,...]
+*
+*	where "→" may be used in place of "->". Blank lines and lines
+*	starting with '#' are ignored.
+ */
+func readEdges(file string) ([]Edge, error) {
+	var edges []Edge
+	f, err := os.Open(file)
+	if err != nil {
+		return edges, errors.New("Unable to open edge-list file '" + terminal.ColorizeBold(file, 36) + "'")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(strings.Replace(scanner.Text(), "→", "->", -1))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split_line := strings.SplitN(line, "->", 2)
+		if len(split_line) != 2 {
+			return edges, errors.New("Invalid edge on line " + strconv.Itoa(lineNum) + " of '" + file + "': " + line)
+		}
+		fields := strings.Fields(split_line[1])
+		if strings.TrimSpace(split_line[0]) == "" || len(fields) == 0 || len(fields) > 2 {
+			return edges, errors.New("Invalid edge on line " + strconv.Itoa(lineNum) + " of '" + file + "': " + line)
+		}
+		edge := Edge{Source: strings.TrimSpace(split_line[0]), Target: fields[0]}
+		if len(fields) == 2 {
+			edge.Dbs = strings.Split(fields[1], ",")
+		}
+		edges = append(edges, edge)
+	}
+	return edges, scanner.Err()
+}
+
+/*
+*	Turns edges into replications. Every region named in an edge must
+*	have resolved to a CloudantAccount. Regions that no edge
+*	replicates into are reported, since they would never receive data.
+ */
+func resolveEdges(edges []Edge, cloudantAccounts []cam.CloudantAccount) ([]Replication, error) {
+	var replications []Replication
+	var unresolved []string
+	for i := 0; i < len(edges); i++ {
+		source, sourceFound := bcr_utils.FindAccount(edges[i].Source, cloudantAccounts)
+		target, targetFound := bcr_utils.FindAccount(edges[i].Target, cloudantAccounts)
+		if !sourceFound && !bcr_utils.IsValid(edges[i].Source, unresolved) {
+			unresolved = append(unresolved, edges[i].Source)
+		}
+		if !targetFound && !bcr_utils.IsValid(edges[i].Target, unresolved) {
+			unresolved = append(unresolved, edges[i].Target)
+		}
+		if sourceFound && targetFound {
+			if source.Username == target.Username {
+				return replications, errors.New("Edge '" + edges[i].Source + " -> " + edges[i].Target +
+					"' replicates a region into itself")
+			}
+			replications = append(replications, Replication{Source: source, Target: target, Dbs: edges[i].Dbs})
+		}
+	}
+	if len(unresolved) > 0 {
+		return replications, errors.New("No Cloudant service was found for the following regions in the edge-list file: " +
+			terminal.ColorizeBold(strings.Join(unresolved, ", "), 36))
+	}
+	for i := 0; i < len(cloudantAccounts); i++ {
+		reached := false
+		for j := 0; j < len(replications); j++ {
+			if replications[j].Target.Username == cloudantAccounts[i].Username {
+				reached = true
+			}
+		}
+		if !reached {
+			fmt.Println(terminal.ColorizeBold("WARNING", 33) + ": no edge replicates into '" +
+				terminal.ColorizeBold(cloudantAccounts[i].Endpoint, 36) + "', it will not receive any data\n")
+		}
+	}
+	return replications, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
+	"github.com/ibmjstart/bluemix-cloudant-replicator/utils"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var topologyAccounts = []cam.CloudantAccount{
+	{Username: "acct-ng", Endpoint: "https://api.ng.bluemix.net"},
+	{Username: "acct-eu", Endpoint: "https://api.eu-gb.bluemix.net"},
+	{Username: "acct-au", Endpoint: "https://api.au-syd.bluemix.net"},
+}
+
+/*
+*	Parses a raw _security body the way getSecurity does
+ */
+func newSecurity(t *testing.T, model string, body string) Security {
+	sec := Security{Model: model, Body: body}
+	if err := json.Unmarshal([]byte(body), &sec.Parsed); err != nil {
+		t.Fatalf("invalid _security body %s: %v", body, err)
+	}
+	return sec
+}
+
+/*
+*	Writes contents to a temporary file and returns its name
+ */
+func writeTestFile(t *testing.T, prefix string, contents string) string {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		t.Fatalf("unable to create a %s file: %v", prefix, err)
+	}
+	f.WriteString(contents)
+	f.Close()
+	return f.Name()
+}
+
+/*
+*	Describes replications as sorted "source->target" region pairs
+ */
+func describeReplications(replications []Replication) []string {
+	var pairs []string
+	for i := 0; i < len(replications); i++ {
+		pair := bcr_utils.GetRegion(replications[i].Source.Endpoint) + "->" + bcr_utils.GetRegion(replications[i].Target.Endpoint)
+		for j := 0; j < len(replications[i].Dbs); j++ {
+			pair += " " + replications[i].Dbs[j]
+		}
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func TestGetReplications(t *testing.T) {
+	edgeFile := writeTestFile(t, "edges", "# orders only go one way\nng -> eu-gb orders\neu-gb → au-syd\n\nau-syd -> ng users,orders\n")
+	defer os.Remove(edgeFile)
+	tests := []struct {
+		name     string
+		flags    bcr_utils.Flags
+		expected []string
+		fails    bool
+	}{
+		{"mesh", bcr_utils.Flags{Topology: "mesh"},
+			[]string{"au-syd->eu-gb", "au-syd->ng", "eu-gb->au-syd", "eu-gb->ng", "ng->au-syd", "ng->eu-gb"}, false},
+		{"mesh by default", bcr_utils.Flags{},
+			[]string{"au-syd->eu-gb", "au-syd->ng", "eu-gb->au-syd", "eu-gb->ng", "ng->au-syd", "ng->eu-gb"}, false},
+		{"hub", bcr_utils.Flags{Topology: "hub", Hub: "ng"},
+			[]string{"au-syd->ng", "eu-gb->ng", "ng->au-syd", "ng->eu-gb"}, false},
+		{"hub by endpoint", bcr_utils.Flags{Topology: "hub", Hub: "https://api.eu-gb.bluemix.net"},
+			[]string{"au-syd->eu-gb", "eu-gb->au-syd", "eu-gb->ng", "ng->eu-gb"}, false},
+		{"unknown hub", bcr_utils.Flags{Topology: "hub", Hub: "us-east"}, nil, true},
+		{"primary", bcr_utils.Flags{Topology: "primary", Primary: "eu-gb"},
+			[]string{"eu-gb->au-syd", "eu-gb->ng"}, false},
+		{"unknown primary", bcr_utils.Flags{Topology: "primary", Primary: "us-east"}, nil, true},
+		{"edges", bcr_utils.Flags{Topology: "edges", Edges: edgeFile},
+			[]string{"au-syd->ng users orders", "eu-gb->au-syd", "ng->eu-gb orders"}, false},
+		{"missing edge-list file", bcr_utils.Flags{Topology: "edges", Edges: edgeFile + "-missing"}, nil, true},
+	}
+	for i := 0; i < len(tests); i++ {
+		replications, err := getReplications(tests[i].flags, topologyAccounts)
+		if tests[i].fails {
+			if err == nil {
+				t.Fatalf("%s: expected an error", tests[i].name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tests[i].name, err)
+		}
+		if pairs := describeReplications(replications); !reflect.DeepEqual(pairs, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].name, tests[i].expected, pairs)
+		}
+	}
+}
+
+func TestResolveEdgesRejectsUnknownRegions(t *testing.T) {
+	_, err := resolveEdges([]Edge{{Source: "ng", Target: "us-east"}}, topologyAccounts)
+	if err == nil {
+		t.Fatalf("expected an error for an unknown region")
+	}
+	_, err = resolveEdges([]Edge{{Source: "ng", Target: "ng"}}, topologyAccounts)
+	if err == nil {
+		t.Fatalf("expected an error for an edge into itself")
+	}
+}
+
+func TestGetGrants(t *testing.T) {
+	ng, eu, au := topologyAccounts[0], topologyAccounts[1], topologyAccounts[2]
+	mesh, _ := getReplications(bcr_utils.Flags{Topology: "mesh"}, topologyAccounts)
+	hub, _ := getReplications(bcr_utils.Flags{Topology: "hub", Hub: "ng"}, topologyAccounts)
+	primary, _ := getReplications(bcr_utils.Flags{Topology: "primary", Primary: "ng"}, topologyAccounts)
+	edges := []Replication{{Source: ng, Target: eu}, {Source: eu, Target: au}}
+	keyed := []Replication{{Source: ng, Target: eu, Key: ApiKey{Key: "key-1", Password: "secret"}}}
+	read, readWrite := []string{"_reader"}, []string{"_reader", "_writer"}
+	tests := []struct {
+		name         string
+		account      cam.CloudantAccount
+		replications []Replication
+		placement    string
+		expected     map[string][]string
+	}{
+		{"mesh pull", ng, mesh, "pull", map[string][]string{"acct-eu": read, "acct-au": read}},
+		{"mesh push", ng, mesh, "push", map[string][]string{"acct-eu": readWrite, "acct-au": readWrite}},
+		{"hub pull on the hub", ng, hub, "pull", map[string][]string{"acct-eu": read, "acct-au": read}},
+		{"hub pull on a spoke", eu, hub, "pull", map[string][]string{"acct-ng": read}},
+		{"hub push on a spoke", eu, hub, "push", map[string][]string{"acct-ng": readWrite}},
+		{"primary pull on the primary", ng, primary, "pull", map[string][]string{"acct-eu": read, "acct-au": read}},
+		{"primary pull on a replica", eu, primary, "pull", map[string][]string{}},
+		{"primary push on the primary", ng, primary, "push", map[string][]string{}},
+		{"primary push on a replica", au, primary, "push", map[string][]string{"acct-ng": readWrite}},
+		{"edges pull in the middle", eu, edges, "pull", map[string][]string{"acct-au": read}},
+		{"edges push in the middle", eu, edges, "push", map[string][]string{"acct-ng": readWrite}},
+		{"edges pull at the end", au, edges, "pull", map[string][]string{}},
+		{"api key on the source", ng, keyed, "pull", map[string][]string{"key-1": {"_reader", "_replicator"}}},
+		{"api key on the target", eu, keyed, "push", map[string][]string{"key-1": readWrite}},
+		{"api key elsewhere", au, keyed, "pull", map[string][]string{}},
+	}
+	for i := 0; i < len(tests); i++ {
+		grants := getGrants(tests[i].account, tests[i].replications, tests[i].placement)
+		if !reflect.DeepEqual(grants, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].name, tests[i].expected, grants)
+		}
+	}
+}
+
+func TestAccountsForDatabase(t *testing.T) {
+	dbRegions := map[string][]string{
+		"orders": {"ng", "https://api.eu-gb.bluemix.net"},
+		"users":  {"au-syd", "us-east"},
+	}
+	tests := []struct {
+		db       string
+		expected []string
+	}{
+		{"orders", []string{"acct-ng", "acct-eu"}},
+		{"users", []string{"acct-au"}},
+		{"events", []string{"acct-ng", "acct-eu", "acct-au"}},
+	}
+	for i := 0; i < len(tests); i++ {
+		var usernames []string
+		accounts := accountsForDatabase(tests[i].db, dbRegions, topologyAccounts)
+		for j := 0; j < len(accounts); j++ {
+			usernames = append(usernames, accounts[j].Username)
+		}
+		if !reflect.DeepEqual(usernames, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].db, tests[i].expected, usernames)
+		}
+	}
+}
+
+func TestReplicationsForDatabase(t *testing.T) {
+	ng, eu, au := topologyAccounts[0], topologyAccounts[1], topologyAccounts[2]
+	replications := []Replication{
+		{Source: ng, Target: eu, Dbs: []string{"orders"}},
+		{Source: eu, Target: au},
+		{Source: au, Target: ng, Dbs: []string{"users"}},
+	}
+	tests := []struct {
+		name       string
+		db         string
+		dbAccounts []cam.CloudantAccount
+		expected   []string
+	}{
+		{"every account", "orders", topologyAccounts, []string{"eu-gb->au-syd", "ng->eu-gb orders"}},
+		{"listed database", "users", topologyAccounts, []string{"au-syd->ng users", "eu-gb->au-syd"}},
+		{"database in some accounts", "orders", []cam.CloudantAccount{ng, eu}, []string{"ng->eu-gb orders"}},
+		{"database in one account", "events", []cam.CloudantAccount{au}, nil},
+	}
+	for i := 0; i < len(tests); i++ {
+		pairs := describeReplications(replicationsForDatabase(tests[i].db, replications, tests[i].dbAccounts))
+		if !reflect.DeepEqual(pairs, tests[i].expected) {
+			t.Fatalf("%s: expected %v, got %v", tests[i].name, tests[i].expected, pairs)
+		}
+	}
+}
+
+func TestApplyGrantsPrunes(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		body     string
+		grants   map[string][]string
+		prune    []string
+		changed  bool
+		removed  map[string][]string
+		expected string
+	}{
+		{"grants a new account", "cloudant", `{"cloudant":{"acct-ng":["_admin"]}}`,
+			map[string][]string{"acct-eu": {"_reader"}}, nil, true, map[string][]string{},
+			`{"bc_replicator_members":["acct-eu"],"cloudant":{"acct-eu":["_reader"],"acct-ng":["_admin"]}}`},
+		{"never grants the owner", "cloudant", `{"cloudant":{}}`,
+			map[string][]string{"acct-ng": {"_reader"}}, nil, false, map[string][]string{}, `{"cloudant":{}}`},
+		{"prunes an account no replication needs", "cloudant",
+			`{"bc_replicator_members":["acct-au"],"cloudant":{"acct-au":["_reader"],"acct-eu":["_reader"]}}`,
+			map[string][]string{"acct-eu": {"_reader"}}, []string{"acct-eu", "acct-au"}, true,
+			map[string][]string{"acct-au": {"_reader"}}, `{"cloudant":{"acct-eu":["_reader"]}}`},
+		{"keeps roles granted by hand", "cloudant", `{"cloudant":{"acct-au":["_admin","_reader","_writer"]}}`,
+			map[string][]string{"acct-au": {"_reader"}}, []string{"acct-au"}, true,
+			map[string][]string{"acct-au": {"_writer"}}, `{"cloudant":{"acct-au":["_admin","_reader"]}}`},
+		{"never prunes the owner", "cloudant", `{"cloudant":{"acct-ng":["_reader","_writer"]}}`,
+			map[string][]string{}, []string{"acct-ng"}, false, map[string][]string{},
+			`{"cloudant":{"acct-ng":["_reader","_writer"]}}`},
+		{"prunes a stale api key", "cloudant", `{"bc_replicator_members":["key-1"],"cloudant":{"key-1":["_reader","_replicator"]}}`,
+			map[string][]string{}, []string{"key-1"}, true,
+			map[string][]string{"key-1": {"_reader", "_replicator"}}, `{"cloudant":{}}`},
+		{"prunes a member the plugin added", "couchdb",
+			`{"bc_replicator_members":["acct-au"],"admins":{"names":[],"roles":[]},"members":{"names":["app","acct-au"],"roles":[]}}`,
+			map[string][]string{}, []string{"acct-au"}, true, map[string][]string{"acct-au": {"member"}},
+			`{"admins":{"names":[],"roles":[]},"members":{"names":["app"],"roles":[]}}`},
+		{"keeps a member added by hand", "couchdb", `{"members":{"names":["app","acct-au"],"roles":[]}}`,
+			map[string][]string{}, []string{"acct-au"}, false, map[string][]string{},
+			`{"members":{"names":["app","acct-au"],"roles":[]}}`},
+	}
+	for i := 0; i < len(tests); i++ {
+		sec := newSecurity(t, tests[i].model, tests[i].body)
+		changed, removed := applyGrants(sec, "acct-ng", tests[i].grants, tests[i].prune)
+		if changed != tests[i].changed {
+			t.Fatalf("%s: expected changed to be %v", tests[i].name, tests[i].changed)
+		}
+		if !reflect.DeepEqual(removed, tests[i].removed) {
+			t.Fatalf("%s: expected %v to be removed, got %v", tests[i].name, tests[i].removed, removed)
+		}
+		if body, _ := json.Marshal(sec.Parsed); string(body) != tests[i].expected {
+			t.Fatalf("%s: expected %s, got %s", tests[i].name, tests[i].expected, body)
+		}
+	}
+}
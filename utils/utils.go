@@ -10,6 +10,7 @@ import (
 	"github.com/ibmjstart/bluemix-cloudant-replicator/CloudantAccountModel"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -126,9 +127,10 @@ func GetDatabases(httpClient *http.Client, account cam.CloudantAccount) []string
 
 /*
 *	Requests all databases for a given Cloudant account
-*	and returns them as a string array
+*	and returns them as a string array, leaving out the
+*	replicator databases
  */
-func GetAllDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount) []string {
+func GetAllDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAccount, replicatorDb string) []string {
 	var all_dbs []string
 	db_ch := make(chan []string)
 	for i := 0; i < len(cloudantAccounts); i++ {
@@ -143,7 +145,7 @@ func GetAllDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAcc
 		case dbs := <-db_ch:
 			if len(dbs) != 0 {
 				for j := 0; j < len(dbs); j++ {
-					if dbs[j] != "_replicator" && !IsValid(dbs[j], all_dbs) {
+					if dbs[j] != "_replicator" && dbs[j] != replicatorDb && !IsValid(dbs[j], all_dbs) {
 						all_dbs = append(all_dbs, dbs[j])
 					}
 				}
@@ -159,35 +161,342 @@ func GetAllDatabases(httpClient *http.Client, cloudantAccounts []cam.CloudantAcc
 	return all_dbs
 }
 
-func HandleFlags(args []string) (string, []string, string, bool, bool) {
-	var appname, password string
-	var dbs []string
-	all_dbs := false
-	create := false
+/*
+*	Options passed to the plugin's commands. Args holds the
+*	positional arguments following the command name.
+ */
+type Flags struct {
+	Args           []string
+	AppName        string
+	Dbs            []string
+	Password       string
+	AllDbs         bool
+	Create         bool
+	Topology       string
+	Hub            string
+	Primary        string
+	Edges          string
+	Placement      string
+	Once           bool
+	DbRegions      map[string][]string
+	DbRegionFile   string
+	ReplicatorDb   string
+	RepOptions     []string
+	RepTemplate    string
+	To             string
+	From           string
+	Shards         int
+	ShardMinSize   int
+	Format         string
+	Output         string
+	Filter         string
+	QueryParams    []string
+	Selector       string
+	DocIds         []string
+	DesignDocs     string
+	LocalOnly      []string
+	RedactionRules string
+	Policy         string
+	PolicyCheck    bool
+	ToApp          string
+	Percent        float64
+	Count          int
+	Seed           string
+	RefFields      []string
+	ApiKeys        bool
+	Foreground     bool
+}
+
+func HandleFlags(args []string) Flags {
+	flags := Flags{Topology: "mesh", Placement: "pull", DbRegions: make(map[string][]string), ReplicatorDb: "_replicator"}
 	err := errors.New("Problem with command invocation. For help look to '" +
-		terminal.ColorizeBold("cf help cloudant-replicate", 33) + "'")
+		terminal.ColorizeBold("cf help "+args[0], 33) + "'")
 	for i := 1; i < len(args); i++ {
 		switch args[i] {
 		case "-a":
 			if i+1 >= len(args) {
 				CheckErrorFatal(err)
 			}
-			appname = args[i+1]
+			flags.AppName = args[i+1]
+			i++
 		case "-d":
 			if i+1 >= len(args) {
 				CheckErrorFatal(err)
 			}
-			dbs = strings.Split(args[i+1], ",")
+			flags.Dbs = strings.Split(args[i+1], ",")
+			i++
 		case "-p":
 			if i+1 >= len(args) {
 				CheckErrorFatal(err)
 			}
-			password = args[i+1]
+			flags.Password = args[i+1]
+			i++
 		case "--all-dbs":
-			all_dbs = true
+			flags.AllDbs = true
 		case "--create":
-			create = true
+			flags.Create = true
+		case "--once":
+			flags.Once = true
+		case "--policy-check":
+			flags.PolicyCheck = true
+		case "--api-keys":
+			flags.ApiKeys = true
+		case "--foreground":
+			flags.Foreground = true
+		case "--skip-design-docs":
+			if flags.DesignDocs == "only" {
+				CheckErrorFatal(err)
+			}
+			flags.DesignDocs = "skip"
+		case "--only-design-docs":
+			if flags.DesignDocs == "skip" {
+				CheckErrorFatal(err)
+			}
+			flags.DesignDocs = "only"
+		case "--topology":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Topology = args[i+1]
+			i++
+		case "--hub":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Hub = args[i+1]
+			i++
+		case "--primary":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Topology = "primary"
+			flags.Primary = args[i+1]
+			i++
+		case "--edges":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Topology = "edges"
+			flags.Edges = args[i+1]
+			i++
+		case "--placement":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Placement = args[i+1]
+			i++
+		case "--db-regions":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			split_arg := strings.SplitN(args[i+1], "=", 2)
+			if len(split_arg) != 2 || split_arg[0] == "" || split_arg[1] == "" {
+				CheckErrorFatal(err)
+			}
+			flags.DbRegions[split_arg[0]] = strings.Split(split_arg[1], ",")
+			i++
+		case "--db-regions-file":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.DbRegionFile = args[i+1]
+			i++
+		case "--replicator-db":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.ReplicatorDb = args[i+1]
+			i++
+		case "--rep-options":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.RepOptions = append(flags.RepOptions, strings.Split(args[i+1], ",")...)
+			i++
+		case "--rep-template":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.RepTemplate = args[i+1]
+			i++
+		case "--to":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.To = args[i+1]
+			i++
+		case "--from":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.From = args[i+1]
+			i++
+		case "--shards":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			shards, convErr := strconv.Atoi(args[i+1])
+			if convErr != nil || shards < 1 || shards > 16 {
+				CheckErrorFatal(errors.New("'" + terminal.ColorizeBold("--shards", 33) + "' takes a number from 1 to 16"))
+			}
+			flags.Shards = shards
+			i++
+		case "--shard-min-size":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			size, convErr := strconv.Atoi(args[i+1])
+			if convErr != nil || size < 0 {
+				CheckErrorFatal(errors.New("'" + terminal.ColorizeBold("--shard-min-size", 33) + "' takes a size in MB"))
+			}
+			flags.ShardMinSize = size
+			i++
+		case "--format":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Format = args[i+1]
+			i++
+		case "-o":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Output = args[i+1]
+			i++
+		case "--filter":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Filter = args[i+1]
+			i++
+		case "--query-params":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.QueryParams = append(flags.QueryParams, strings.Split(args[i+1], ",")...)
+			i++
+		case "--selector":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Selector = args[i+1]
+			i++
+		case "--doc-ids":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.DocIds = append(flags.DocIds, strings.Split(args[i+1], ",")...)
+			i++
+		case "--local-only":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.LocalOnly = append(flags.LocalOnly, args[i+1])
+			i++
+		case "--redaction-rules":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.RedactionRules = args[i+1]
+			i++
+		case "--policy":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Policy = args[i+1]
+			i++
+		case "--to-app":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.ToApp = args[i+1]
+			i++
+		case "--percent":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			percent, convErr := strconv.ParseFloat(args[i+1], 64)
+			if convErr != nil || percent <= 0 || percent > 100 {
+				CheckErrorFatal(errors.New("'" + terminal.ColorizeBold("--percent", 33) + "' takes a percentage above 0 and up to 100"))
+			}
+			flags.Percent = percent
+			i++
+		case "--count":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			count, convErr := strconv.Atoi(args[i+1])
+			if convErr != nil || count < 1 {
+				CheckErrorFatal(errors.New("'" + terminal.ColorizeBold("--count", 33) + "' takes a number of documents"))
+			}
+			flags.Count = count
+			i++
+		case "--seed":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.Seed = args[i+1]
+			i++
+		case "--ref-fields":
+			if i+1 >= len(args) {
+				CheckErrorFatal(err)
+			}
+			flags.RefFields = append(flags.RefFields, strings.Split(args[i+1], ",")...)
+			i++
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				CheckErrorFatal(err)
+			}
+			flags.Args = append(flags.Args, args[i])
+		}
+	}
+	if flags.Topology != "mesh" && flags.Topology != "hub" && flags.Topology != "primary" && flags.Topology != "edges" {
+		CheckErrorFatal(errors.New("Unknown topology '" + flags.Topology + "'. Use '" +
+			terminal.ColorizeBold("mesh", 33) + "', '" + terminal.ColorizeBold("hub", 33) + "', '" +
+			terminal.ColorizeBold("primary", 33) + "' or '" + terminal.ColorizeBold("edges", 33) + "'"))
+	}
+	if flags.Topology == "hub" && flags.Hub == "" {
+		CheckErrorFatal(errors.New("The hub topology requires a region passed with '" +
+			terminal.ColorizeBold("--hub", 33) + "'"))
+	}
+	if flags.Topology == "primary" && flags.Primary == "" {
+		CheckErrorFatal(errors.New("The primary topology requires a region passed with '" +
+			terminal.ColorizeBold("--primary", 33) + "'"))
+	}
+	if flags.PolicyCheck && flags.Policy == "" {
+		CheckErrorFatal(errors.New("'" + terminal.ColorizeBold("--policy-check", 33) + "' requires a policy file passed with '" +
+			terminal.ColorizeBold("--policy", 33) + "'"))
+	}
+	if flags.Placement != "pull" && flags.Placement != "push" {
+		CheckErrorFatal(errors.New("Unknown placement '" + flags.Placement + "'. Use '" +
+			terminal.ColorizeBold("pull", 33) + "' or '" + terminal.ColorizeBold("push", 33) + "'"))
+	}
+	if flags.Topology == "edges" && flags.Edges == "" {
+		CheckErrorFatal(errors.New("The edges topology requires a file passed with '" +
+			terminal.ColorizeBold("--edges", 33) + "'"))
+	}
+	return flags
+}
+
+/*
+*	Returns the short region name of a Bluemix endpoint, e.g.
+*	"eu-gb" for "https://api.eu-gb.bluemix.net"
+ */
+func GetRegion(endpoint string) string {
+	region := strings.TrimPrefix(endpoint, "https://")
+	region = strings.TrimPrefix(region, "api.")
+	return strings.TrimSuffix(region, ".bluemix.net")
+}
+
+/*
+*	Finds the CloudantAccount belonging to a region. The region can
+*	be given either by its short name or by its full endpoint.
+ */
+func FindAccount(region string, cloudantAccounts []cam.CloudantAccount) (cam.CloudantAccount, bool) {
+	for i := 0; i < len(cloudantAccounts); i++ {
+		if region == cloudantAccounts[i].Endpoint || region == GetRegion(cloudantAccounts[i].Endpoint) {
+			return cloudantAccounts[i], true
 		}
 	}
-	return appname, dbs, password, all_dbs, create
+	return cam.CloudantAccount{}, false
 }